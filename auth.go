@@ -0,0 +1,162 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH authentication methods of Network.Auth.
+const (
+	AuthPublicKey           = "publickey"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// credentials are the network's authentication methods, SSH and sudo
+// passwords, shared by all its hosts. Unless configured, the passwords
+// are prompted for once, when a host asks for them first.
+type credentials struct {
+	network  string
+	methods  []string
+	password string
+
+	once sync.Once
+	err  error
+
+	sudoPassword string
+	sudoOnce     sync.Once
+	sudoErr      error
+}
+
+// newCredentials returns credentials of the network. Passwords may reference
+// env vars, ie. `$DB_PASSWORD`, including the ones of secret providers.
+func newCredentials(network *Network, vars EnvList) *credentials {
+	cr := &credentials{
+		network: network.Name,
+		methods: network.Auth,
+	}
+	lookup := func(key string) (string, bool) {
+		for i := len(vars) - 1; i >= 0; i-- {
+			if vars[i].Key == key {
+				return vars[i].Value, true
+			}
+		}
+		return os.LookupEnv(key)
+	}
+	if network.Password != "" {
+		cr.password = expandRefs(network.Password, lookup)
+		cr.once.Do(func() {}) // Never prompt.
+	}
+	if network.BecomePassword != "" {
+		cr.sudoPassword = expandRefs(network.BecomePassword, lookup)
+		cr.sudoOnce.Do(func() {}) // Never prompt.
+	}
+	if len(cr.methods) == 0 {
+		cr.methods = []string{AuthPublicKey}
+		if network.Password != "" {
+			cr.methods = append(cr.methods, AuthPassword)
+		}
+	}
+	return cr
+}
+
+// getPassword returns the password, prompting for it the first time.
+func (cr *credentials) getPassword() (string, error) {
+	cr.once.Do(func() {
+		cr.password, cr.err = readPassword(fmt.Sprintf("SSH password of network %v: ", cr.network))
+	})
+	return cr.password, cr.err
+}
+
+// getSudoPassword returns the sudo password of become commands,
+// prompting for it the first time.
+func (cr *credentials) getSudoPassword() (string, error) {
+	cr.sudoOnce.Do(func() {
+		cr.sudoPassword, cr.sudoErr = readPassword(fmt.Sprintf("Sudo password of network %v: ", cr.network))
+	})
+	return cr.sudoPassword, cr.sudoErr
+}
+
+// authMethods returns SSH authentication methods of the client in the
+// order of credentials. Methods used during handshake are recorded
+// to c.tried, so that authentication failures can tell what was tried.
+func (c *SSHClient) authMethods() []ssh.AuthMethod {
+	methods := []string{AuthPublicKey}
+	if c.creds != nil {
+		methods = c.creds.methods
+	}
+
+	var auth []ssh.AuthMethod
+	for _, method := range methods {
+		switch method {
+		case AuthPublicKey:
+			auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				signers := append(append([]ssh.Signer{}, c.signers...), authSigners...)
+				c.tried = append(c.tried, fmt.Sprintf("publickey (%v keys)", len(signers)))
+				return signers, nil
+			}))
+
+		case AuthPassword:
+			auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+				password, err := c.creds.getPassword()
+				if err != nil {
+					c.tried = append(c.tried, fmt.Sprintf("password (%v)", err))
+					return "", err
+				}
+				c.tried = append(c.tried, "password")
+				return password, nil
+			}))
+
+		case AuthKeyboardInteractive:
+			auth = append(auth, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers, err := c.keyboardInteractive(instruction, questions, echos)
+				if err != nil {
+					c.tried = append(c.tried, fmt.Sprintf("keyboard-interactive (%v)", err))
+					return nil, err
+				}
+				c.tried = append(c.tried, "keyboard-interactive")
+				return answers, nil
+			}))
+		}
+	}
+	return auth
+}
+
+// keyboardInteractive answers the server's challenge on the terminal.
+// Password questions are answered by the network password, if configured.
+func (c *SSHClient) keyboardInteractive(instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		if c.creds != nil && strings.Contains(strings.ToLower(question), "password") {
+			password, err := c.creds.getPassword()
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = password
+			continue
+		}
+
+		prompt := fmt.Sprintf("(%v@%v) ", c.user, c.host)
+		if instruction != "" {
+			prompt += instruction + "\n"
+		}
+		answer, err := readLine(prompt+question, echos[i])
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// authError describes failed authentication with the methods tried.
+func (c *SSHClient) authError() string {
+	if len(c.tried) == 0 {
+		return "authentication failed, server allows none of the configured methods"
+	}
+	return "authentication failed, tried " + strings.Join(c.tried, ", ")
+}
@@ -0,0 +1,131 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// sudoPrompt is the sudo password prompt, unique to this run, so it can
+// be told apart from the command output.
+var sudoPrompt = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "[sup:sudo-password:" + hex.EncodeToString(b) + "]"
+}()
+
+// sudoCommand wraps the command to be run by sudo as the given user,
+// root by default. Env vars of the keep keys, ie. secrets sourced before
+// sudo, are preserved.
+func sudoCommand(user, command string, keep []string) string {
+	sudo := "sudo -H -p " + shellQuote(sudoPrompt)
+	if user != "" {
+		sudo += " -u " + shellQuote(user)
+	}
+	if len(keep) > 0 {
+		sudo += " --preserve-env=" + shellQuote(strings.Join(keep, ","))
+	}
+	return sudo + " -- bash -c " + shellQuote(command)
+}
+
+// sudoPrompter answers sudo password prompts found in the remote PTY
+// output and strips them off. The password is fetched on the first prompt;
+// if sudo asks again, the password was wrong, so it's aborted by Ctrl-C.
+type sudoPrompter struct {
+	r        io.Reader
+	w        io.Writer // Remote STDIN.
+	password func() (string, error)
+
+	prompted bool
+	answered bool   // Newline echoed by sudo after the password is to be skipped.
+	held     []byte // Output that may be the beginning of a prompt.
+	out      []byte // Output ready to be read.
+	err      error
+}
+
+func (p *sudoPrompter) Read(b []byte) (int, error) {
+	for len(p.out) == 0 && p.err == nil {
+		chunk := make([]byte, 32*1024)
+		n, err := p.r.Read(chunk)
+		data := append(p.held, chunk[:n]...)
+		p.held = nil
+		data = p.skipNewline(data)
+
+		for {
+			i := bytes.Index(data, []byte(sudoPrompt))
+			if i == -1 {
+				break
+			}
+			p.out = append(p.out, data[:i]...)
+			data = data[i+len(sudoPrompt):]
+			p.answer()
+			data = p.skipNewline(data)
+		}
+
+		if err == nil {
+			keep := partialPrefix(data, []byte(sudoPrompt))
+			p.held = append(p.held, data[len(data)-keep:]...)
+			data = data[:len(data)-keep]
+		}
+		p.out = append(p.out, data...)
+		p.err = err
+	}
+
+	if len(p.out) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.out)
+	p.out = p.out[n:]
+	return n, nil
+}
+
+// answer writes the password to sudo.
+func (p *sudoPrompter) answer() {
+	if p.prompted {
+		p.out = append(p.out, "sup: incorrect sudo password\r\n"...)
+		p.w.Write([]byte{3})
+		return
+	}
+	p.prompted = true
+
+	password, err := p.password()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sudo password: %v\n", err)
+		p.w.Write([]byte{3})
+		return
+	}
+	p.w.Write([]byte(password + "\n"))
+	p.answered = true
+}
+
+// skipNewline strips the newline echoed by sudo after the password off
+// the beginning of data. It may come in the same chunk as the prompt,
+// or in the following ones.
+func (p *sudoPrompter) skipNewline(data []byte) []byte {
+	if !p.answered || len(data) == 0 {
+		return data
+	}
+	if data[0] == '\r' {
+		data = data[1:]
+		if len(data) == 0 {
+			return data // "\n" may follow.
+		}
+	}
+	p.answered = false
+	return bytes.TrimPrefix(data, []byte("\n"))
+}
+
+// partialPrefix returns length of the longest suffix of data, that is
+// a prefix of s.
+func partialPrefix(data, s []byte) int {
+	for n := len(s) - 1; n > 0; n-- {
+		if len(data) >= n && bytes.Equal(data[len(data)-n:], s[:n]) {
+			return n
+		}
+	}
+	return 0
+}
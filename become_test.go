@@ -0,0 +1,121 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// chunkReader reads data in chunks of the given size.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.size
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	n = copy(b, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSudoPrompter(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		output  string
+		written string
+		asked   int
+	}{
+		{
+			name:    "prompt",
+			input:   "before\r\n" + sudoPrompt + "\r\nafter\r\n",
+			output:  "before\r\nafter\r\n",
+			written: "secret\n",
+			asked:   1,
+		},
+		{
+			name:    "prompt only",
+			input:   sudoPrompt + "\r\n",
+			output:  "",
+			written: "secret\n",
+			asked:   1,
+		},
+		{
+			name:    "no newline echoed",
+			input:   sudoPrompt + "output",
+			output:  "output",
+			written: "secret\n",
+			asked:   1,
+		},
+		{
+			name:    "no prompt",
+			input:   "[sup:sudo-password: lookalike " + sudoPrompt[:len(sudoPrompt)-1] + "\r\n\r\n",
+			output:  "[sup:sudo-password: lookalike " + sudoPrompt[:len(sudoPrompt)-1] + "\r\n\r\n",
+			written: "",
+			asked:   0,
+		},
+		{
+			name:    "wrong password",
+			input:   sudoPrompt + "\r\nSorry, try again.\r\n" + sudoPrompt + "\r\n",
+			output:  "Sorry, try again.\r\nsup: incorrect sudo password\r\n\r\n",
+			written: "secret\n\x03",
+			asked:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, size := range []int{1, 3, 7, len(tt.input)} {
+			var written bytes.Buffer
+			asked := 0
+			p := &sudoPrompter{
+				r: &chunkReader{data: []byte(tt.input), size: size},
+				w: &written,
+				password: func() (string, error) {
+					asked++
+					return "secret", nil
+				},
+			}
+			output, err := ioutil.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tt.output {
+				t.Errorf("%v, chunks of %v: output %q, want %q", tt.name, size, output, tt.output)
+			}
+			if written.String() != tt.written {
+				t.Errorf("%v, chunks of %v: written %q, want %q", tt.name, size, written.String(), tt.written)
+			}
+			if asked != tt.asked {
+				t.Errorf("%v, chunks of %v: password asked %v times, want %v", tt.name, size, asked, tt.asked)
+			}
+		}
+	}
+}
+
+func TestPartialPrefix(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+	}{
+		{"", 0},
+		{"output", 0},
+		{"output[", 1},
+		{"output[sup:", 5},
+		{"[sup:x", 0},
+		{sudoPrompt, 0}, // Complete prompts are not partial.
+		{sudoPrompt[:len(sudoPrompt)-1], len(sudoPrompt) - 1},
+	}
+	for _, tt := range tests {
+		if n := partialPrefix([]byte(tt.data), []byte(sudoPrompt)); n != tt.n {
+			t.Errorf("partialPrefix(%q) = %v, want %v", tt.data, n, tt.n)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/sup"
+)
+
+var ErrCompletionUsage = errors.New("Usage: sup completion [ bash | zsh | fish ]")
+
+// The completion scripts call back `sup __complete WORDS...`, where the last
+// word is the one being completed.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for sup, add to ~/.bashrc:
+# source <(sup completion bash)
+_sup_complete() {
+    local line="${COMP_LINE:0:COMP_POINT}" words
+    read -ra words <<< "$line"
+    [[ "$line" == *" " ]] && words+=("")
+    local cur="${words[${#words[@]}-1]}"
+
+    local IFS=$'\n'
+    COMPREPLY=($("${words[0]}" __complete "${words[@]:1}" 2>/dev/null))
+
+    # Commands may contain ":", which bash treats as a word break.
+    if [[ "$cur" == *:* && "$COMP_WORDBREAKS" == *:* ]]; then
+        local prefix="${cur%"${cur##*:}"}"
+        COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+    fi
+    if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == */ ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _sup_complete sup
+`,
+	"zsh": `#compdef sup
+# zsh completion for sup, add to ~/.zshrc:
+# source <(sup completion zsh)
+_sup() {
+    local -a candidates
+    candidates=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    candidates=(${candidates:#})
+    compadd -S '' -q -- ${(M)candidates:#*/}
+    compadd -- ${candidates:#*/}
+}
+compdef _sup sup
+`,
+	"fish": `# fish completion for sup, add to ~/.config/fish/config.fish:
+# sup completion fish | source
+function __sup_complete
+    set -l tokens (commandline -opc)
+    set -l current (commandline -ct)
+    $tokens[1] __complete $tokens[2..-1] "$current" 2>/dev/null
+end
+complete -c sup -f -a '(__sup_complete)'
+`,
+}
+
+// completion prints completion script for the given shell.
+func completion(args []string) error {
+	if len(args) != 1 {
+		return ErrCompletionUsage
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return ErrCompletionUsage
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// complete prints candidates for the last of the words.
+func complete(words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+
+	// Find positional args and the Supfile path.
+	var args []string
+	var prev string
+	for i := 0; i < len(words)-1; i++ {
+		word := words[i]
+		prev = ""
+		if len(word) > 1 && word[0] == '-' {
+			name := strings.TrimLeft(word, "-")
+			if strings.Contains(name, "=") || isBoolFlag(name) {
+				continue
+			}
+			if i+1 < len(words)-1 {
+				if name == "f" {
+					supfile = words[i+1]
+				}
+				i++
+				continue
+			}
+			prev = name
+			continue
+		}
+		args = append(args, word)
+	}
+
+	var candidates []string
+	switch {
+	case prev == "f" || prev == "sshconfig":
+		candidates = completeFiles(cur)
+	case prev != "":
+		// Flag value, nothing to suggest.
+	case strings.HasPrefix(cur, "-"):
+		flag.VisitAll(func(f *flag.Flag) {
+			if len(f.Name) == 1 {
+				candidates = append(candidates, "-"+f.Name)
+			} else {
+				candidates = append(candidates, "--"+f.Name)
+			}
+		})
+	case len(args) == 0:
+		candidates = append(completeSupfile("networks"), subcommands...)
+	case len(args) > 1 && args[1] == "--":
+		// Ad-hoc command.
+	case !isSubcommand(args[0]) || isNetwork(args[0]):
+		// Networks named after subcommands take precedence.
+		candidates = append(completeSupfile("commands"), completeSupfile("targets")...)
+	case args[0] == "exec" || args[0] == "shell":
+		if len(args) == 1 {
+			candidates = completeSupfile("networks")
+		}
+	case args[0] == "completion":
+		if len(args) == 1 {
+			candidates = []string{"bash", "zsh", "fish"}
+		}
+	case args[0] == "list":
+		if len(args) == 1 {
+			candidates = []string{"networks", "hosts", "commands", "targets"}
+		} else if len(args) == 2 && args[1] == "hosts" {
+			candidates = completeSupfile("networks")
+		}
+	case args[0] == "secrets":
+		if len(args) == 1 {
+			candidates = []string{"keygen", "encrypt", "decrypt", "edit"}
+		} else if len(args) == 2 && args[1] != "keygen" {
+			candidates = completeFiles(cur)
+		}
+	case args[0] == "schema" || args[0] == "validate":
+	default:
+		candidates = append(completeSupfile("commands"), completeSupfile("targets")...)
+	}
+
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, cur) {
+			fmt.Println(candidate)
+		}
+	}
+}
+
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return true // Unknown flag, don't expect a value.
+	}
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+// completeSupfile returns names of networks, commands or targets defined
+// in Supfile.
+func completeSupfile(what string) []string {
+	path, err := supfilePath()
+	if err != nil {
+		return nil
+	}
+	conf, err := sup.ReadSupfile(path)
+	if err != nil {
+		return nil
+	}
+
+	switch what {
+	case "networks":
+		return conf.Networks.Names
+	case "commands":
+		return conf.Commands.Names
+	case "targets":
+		return conf.Targets.Names
+	}
+	return nil
+}
+
+// isNetwork reports whether Supfile defines network of the name.
+func isNetwork(name string) bool {
+	return hasString(completeSupfile("networks"), name)
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// completeFiles returns files and directories matching prefix.
+func completeFiles(prefix string) []string {
+	matches, _ := filepath.Glob(prefix + "*")
+	sort.Strings(matches)
+	for i, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			matches[i] += "/"
+		}
+	}
+	return matches
+}
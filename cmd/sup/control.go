@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/sup"
+)
+
+// control runs the control master, see sup.ServeControl. It's started
+// in background by sup runs of networks with control_persist.
+func control(args []string) error {
+	fs := flag.NewFlagSet("__control", flag.ContinueOnError)
+	socket := fs.String("socket", "", "control socket")
+	bastion := fs.String("bastion", "", "bastion host")
+	proxy := fs.String("proxy", "", "SOCKS5 or HTTP proxy URL")
+	proxyCommand := fs.String("proxy-command", "", "command to connect through")
+	ttl := fs.Duration("ttl", 10*time.Minute, "idle timeout")
+	aliveInterval := fs.Duration("server-alive-interval", 0, "keepalive interval")
+	aliveCountMax := fs.Int("server-alive-count-max", 3, "keepalives without reply to consider the connection lost")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *socket == "" || fs.NArg() != 1 {
+		return errors.New("Usage: sup __control -socket SOCKET [-bastion HOST] [-ttl DURATION] HOST")
+	}
+	return sup.ServeControl(*socket, fs.Arg(0), *bastion, *proxy, *proxyCommand, *ttl, *aliveInterval, *aliveCountMax)
+}
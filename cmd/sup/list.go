@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/sup"
+)
+
+var ErrListUsage = errors.New("Usage: sup list [ networks | hosts NETWORK | commands | targets ] [--json]")
+
+// list prints networks, hosts, commands or targets defined in Supfile,
+// one per line or as JSON.
+func list(conf *sup.Supfile, args []string) error {
+	asJSON := false
+	var what []string
+	for _, arg := range args {
+		switch arg {
+		case "-json", "--json":
+			asJSON = true
+		default:
+			what = append(what, arg)
+		}
+	}
+	if len(what) < 1 {
+		return ErrListUsage
+	}
+
+	type item struct {
+		Name      string   `json:"name"`
+		Desc      string   `json:"desc,omitempty"`
+		Hosts     []string `json:"hosts,omitempty"`
+		Inventory bool     `json:"inventory,omitempty"` // Hosts of inventory not listed.
+		Tags      []string `json:"tags,omitempty"`
+		Commands  []string `json:"commands,omitempty"`
+	}
+	var items []item
+
+	switch what[0] {
+	case "networks":
+		// Inventories are run by `sup list hosts NETWORK` only.
+		for _, name := range conf.Networks.Names {
+			network, _ := conf.Networks.Get(name)
+			items = append(items, item{
+				Name:      name,
+				Hosts:     network.Hosts,
+				Inventory: network.Inventory != "" || network.InventoryFile != "",
+			})
+		}
+
+	case "hosts":
+		if len(what) != 2 {
+			return ErrListUsage
+		}
+		network, ok := conf.Networks.Get(what[1])
+		if !ok {
+			return errors.Wrap(ErrUnknownNetwork, what[1])
+		}
+		if err := network.ResolveInventory(refreshInventory); err != nil {
+			return err
+		}
+		if err := filterHosts(&network); err != nil {
+			return err
+		}
+		for _, host := range network.Hosts {
+			items = append(items, item{Name: host, Tags: network.HostTags[host]})
+		}
+
+	case "commands":
+		for _, name := range conf.Commands.Names {
+			cmd, _ := conf.Commands.Get(name)
+			items = append(items, item{Name: name, Desc: cmd.Desc})
+		}
+
+	case "targets":
+		for _, name := range conf.Targets.Names {
+			cmds, _ := conf.Targets.Get(name)
+			items = append(items, item{Name: name, Commands: cmds})
+		}
+
+	default:
+		return ErrListUsage
+	}
+
+	if asJSON {
+		if items == nil {
+			items = []item{}
+		}
+		data, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	for _, item := range items {
+		switch {
+		case item.Desc != "":
+			fmt.Fprintf(os.Stdout, "%v\t%v\n", item.Name, item.Desc)
+		case len(item.Commands) > 0:
+			fmt.Fprintf(os.Stdout, "%v\t%v\n", item.Name, strings.Join(item.Commands, " "))
+		case len(item.Tags) > 0:
+			fmt.Fprintf(os.Stdout, "%v\t%v\n", item.Name, strings.Join(item.Tags, " "))
+		case item.Inventory:
+			fmt.Fprintf(os.Stdout, "%v\tinventory\n", item.Name)
+		default:
+			fmt.Fprintln(os.Stdout, item.Name)
+		}
+	}
+	return nil
+}
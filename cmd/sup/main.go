@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -23,6 +22,12 @@ var (
 	sshConfig   string
 	onlyHosts   string
 	exceptHosts string
+	limit       string
+	retryFile   string
+	serial      int
+	once        bool
+
+	refreshInventory bool
 
 	debug         bool
 	disablePrefix bool
@@ -30,7 +35,7 @@ var (
 	showVersion bool
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [OPTIONS] NETWORK -- 'COMMAND'\n       sup [OPTIONS] exec NETWORK 'COMMAND'\n       sup [OPTIONS] shell NETWORK\n       sup validate\n       sup schema\n       sup list [ networks | hosts NETWORK | commands | targets ] [--json]\n       sup completion [ bash | zsh | fish ]\n       sup secrets [ keygen | encrypt | decrypt | edit ] [FILE]\n       sup [ --help | -v | --version ]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
@@ -56,6 +61,11 @@ func init() {
 	flag.StringVar(&sshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
 	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.StringVar(&limit, "limit", "", "Filter hosts by tags and host patterns, ie. 'web:&eu-west:!canary' or @Supfile.retry")
+	flag.StringVar(&retryFile, "retry-file", "", "Write failed hosts to file, defaults to Supfile path + .retry")
+	flag.IntVar(&serial, "serial", 0, "Max number of hosts running ad-hoc command in parallel")
+	flag.BoolVar(&once, "once", false, "Run ad-hoc command on one host only")
+	flag.BoolVar(&refreshInventory, "refresh-inventory", false, "Re-run inventory command, ignoring cached hosts")
 
 	flag.BoolVar(&debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
@@ -80,6 +90,9 @@ func networkUsage(conf *sup.Supfile) {
 		for _, host := range network.Hosts {
 			fmt.Fprintf(w, "\t- %v\n", host)
 		}
+		if network.Inventory != "" {
+			fmt.Fprintf(w, "\t- (inventory)\n")
+		}
 	}
 	fmt.Fprintln(w)
 }
@@ -106,10 +119,25 @@ func cmdUsage(conf *sup.Supfile) {
 
 // parseArgs parses args and returns network and commands to be run.
 // On error, it prints usage and exits.
-func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
+func parseArgs(conf *sup.Supfile, subcmd string) (*sup.Network, []*sup.Command, error) {
 	var commands []*sup.Command
 
 	args := flag.Args()
+
+	// Ad-hoc command, ie. `sup exec NETWORK 'uptime'`.
+	adhoc := false
+	if subcmd == "exec" {
+		args = args[1:]
+		adhoc = true
+	}
+
+	// Interactive shell, ie. `sup shell NETWORK`.
+	interactive := false
+	if subcmd == "shell" {
+		args = args[1:]
+		interactive = true
+	}
+
 	if len(args) < 1 {
 		networkUsage(conf)
 		return nil, nil, ErrUsage
@@ -122,6 +150,11 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		return nil, nil, ErrUnknownNetwork
 	}
 
+	// Run inventory of the selected network only.
+	if err := network.ResolveInventory(refreshInventory); err != nil {
+		return nil, nil, err
+	}
+
 	// Does the <network> have at least one host?
 	if len(network.Hosts) == 0 {
 		networkUsage(conf)
@@ -129,11 +162,18 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	}
 
 	// Check for the second argument
-	if len(args) < 2 {
+	if len(args) < 2 && !interactive {
 		cmdUsage(conf)
 		return nil, nil, ErrUsage
 	}
 
+	network.Name = args[0]
+
+	// Use the default proxy, unless the network has its own.
+	if network.Proxy == "" && network.ProxyCommand == "" {
+		network.Proxy, network.ProxyCommand = conf.Proxy, conf.ProxyCommand
+	}
+
 	// In case of the network.Env needs an initialization
 	if network.Env == nil {
 		network.Env = make(sup.EnvList, 0)
@@ -155,6 +195,32 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		network.Env.Set("SUP_USER", os.Getenv("USER"))
 	}
 
+	if interactive {
+		if len(args) > 1 {
+			return nil, nil, ErrUsage
+		}
+		return &network, nil, nil
+	}
+
+	// Ad-hoc command, ie. `sup NETWORK -- 'uptime; df -h'`.
+	if !adhoc && args[1] == "--" {
+		args = args[1:]
+		adhoc = true
+	}
+	if adhoc {
+		run := strings.TrimSpace(strings.Join(args[1:], " "))
+		if run == "" {
+			return nil, nil, ErrUsage
+		}
+		commands = append(commands, &sup.Command{
+			Name:   "exec",
+			Run:    run,
+			Serial: serial,
+			Once:   once,
+		})
+		return &network, commands, nil
+	}
+
 	for _, cmd := range args[1:] {
 		// Target?
 		target, isTarget := conf.Targets.Get(cmd)
@@ -187,6 +253,56 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	return &network, commands, nil
 }
 
+// filterHosts applies --only, --except and --limit flags to network hosts.
+func filterHosts(network *sup.Network) error {
+	// --only flag filters hosts
+	if onlyHosts != "" {
+		expr, err := regexp.CompilePOSIX(onlyHosts)
+		if err != nil {
+			return err
+		}
+
+		var hosts []string
+		for _, host := range network.Hosts {
+			if expr.MatchString(host) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts)
+		}
+		network.KeepHosts(hosts)
+	}
+
+	// --except flag filters out hosts
+	if exceptHosts != "" {
+		expr, err := regexp.CompilePOSIX(exceptHosts)
+		if err != nil {
+			return err
+		}
+
+		var hosts []string
+		for _, host := range network.Hosts {
+			if !expr.MatchString(host) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return fmt.Errorf("no hosts left after --except '%v' regexp", exceptHosts)
+		}
+		network.KeepHosts(hosts)
+	}
+
+	// --limit flag filters hosts by tags and host patterns
+	if limit != "" {
+		if err := network.Limit(limit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func resolvePath(path string) string {
 	if path[:2] == "~/" {
 		usr, err := user.Current()
@@ -197,9 +313,71 @@ func resolvePath(path string) string {
 	return path
 }
 
+// supfilePath returns path of the Supfile, either -f or ./Supfile[.yml].
+func supfilePath() (string, error) {
+	if supfile == "" {
+		supfile = "./Supfile"
+	}
+	path := resolvePath(supfile)
+	if _, err := os.Stat(path); err != nil {
+		firstErr := err
+		path = "./Supfile.yml" // Alternative to ./Supfile.
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%v\n%v", firstErr, err)
+		}
+	}
+	return path, nil
+}
+
+// Subcommands, which can be used instead of NETWORK.
+var subcommands = []string{"completion", "exec", "list", "schema", "secrets", "shell", "validate"}
+
+func isSubcommand(name string) bool {
+	return hasString(subcommands, name)
+}
+
+// subcommand returns the subcommand given in args, if any. Networks of conf
+// named after subcommands take precedence, so Supfiles defining them keep
+// working.
+func subcommand(conf *sup.Supfile) string {
+	name := flag.Arg(0)
+	if !isSubcommand(name) {
+		return ""
+	}
+	if conf != nil {
+		if _, ok := conf.Networks.Get(name); ok {
+			return ""
+		}
+	}
+	return name
+}
+
+// supEnv returns $SUP_ENV, the -e flags of the vars to be passed on to
+// another sup, ie. `sup $SUP_ENV -f ./other/Supfile`, except for the
+// secrets. The shell splits it by whitespace with no quote removal, so
+// the values are not quoted.
+func supEnv(vars, secrets sup.EnvList) string {
+	secret := map[string]bool{}
+	for _, v := range secrets {
+		secret[v.Key] = true
+	}
+	var flags []string
+	for _, v := range vars {
+		if !secret[v.Key] {
+			flags = append(flags, "-e "+v.Key+"="+v.Value)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
 func main() {
 	flag.Parse()
 
+	// Control masters are run by this binary, see sup.ControlBinary.
+	if exe, err := os.Executable(); err == nil {
+		sup.ControlBinary = exe
+	}
+
 	if showHelp {
 		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
 		flag.PrintDefaults()
@@ -211,72 +389,93 @@ func main() {
 		return
 	}
 
-	if supfile == "" {
-		supfile = "./Supfile"
+	// Hidden subcommand used by the completion scripts.
+	if flag.Arg(0) == "__complete" {
+		complete(flag.Args()[1:])
+		return
 	}
-	data, err := ioutil.ReadFile(resolvePath(supfile))
-	if err != nil {
-		firstErr := err
-		data, err = ioutil.ReadFile("./Supfile.yml") // Alternative to ./Supfile.
-		if err != nil {
-			fmt.Fprintln(os.Stderr, firstErr)
+
+	// Hidden subcommand of the background control masters.
+	if flag.Arg(0) == "__control" {
+		if err := control(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-	}
-	conf, err := sup.NewSupfile(data)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return
 	}
 
-	// Parse network and commands to be run from args.
-	network, commands, err := parseArgs(conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	// Some subcommands don't need the Supfile, so its errors are
+	// reported later.
+	path, pathErr := supfilePath()
+	var conf *sup.Supfile
+	confErr := pathErr
+	if pathErr == nil {
+		conf, confErr = sup.ReadSupfile(path)
 	}
+	subcmd := subcommand(conf)
 
-	// --only flag filters hosts
-	if onlyHosts != "" {
-		expr, err := regexp.CompilePOSIX(onlyHosts)
-		if err != nil {
+	if subcmd == "secrets" {
+		if err := secrets(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		return
+	}
 
-		var hosts []string
-		for _, host := range network.Hosts {
-			if expr.MatchString(host) {
-				hosts = append(hosts, host)
-			}
-		}
-		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts))
+	if subcmd == "completion" {
+		if err := completion(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		network.Hosts = hosts
+		return
 	}
 
-	// --except flag filters out hosts
-	if exceptHosts != "" {
-		expr, err := regexp.CompilePOSIX(exceptHosts)
+	if subcmd == "schema" {
+		schema, err := sup.JSONSchema()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		fmt.Println(string(schema))
+		return
+	}
 
-		var hosts []string
-		for _, host := range network.Hosts {
-			if !expr.MatchString(host) {
-				hosts = append(hosts, host)
-			}
+	if pathErr != nil {
+		fmt.Fprintln(os.Stderr, pathErr)
+		os.Exit(1)
+	}
+
+	if subcmd == "validate" {
+		if err := sup.ValidateFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts))
+		return
+	}
+
+	if confErr != nil {
+		fmt.Fprintln(os.Stderr, confErr)
+		os.Exit(1)
+	}
+
+	if subcmd == "list" {
+		if err := list(conf, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		network.Hosts = hosts
+		return
+	}
+
+	// Parse network and commands to be run from args.
+	network, commands, err := parseArgs(conf, subcmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := filterHosts(network); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	// --sshconfig flag location for ssh_config file
@@ -307,9 +506,28 @@ func main() {
 		}
 	}
 
+	// Env files come first, so they can be overridden by the Supfile env.
 	var vars sup.EnvList
-	for _, val := range append(conf.Env, network.Env...) {
-		vars.Set(val.Key, val.Value)
+	for _, env := range []struct {
+		file string
+		vars sup.EnvList
+	}{
+		{conf.EnvFile, conf.Env},
+		{network.EnvFile, network.Env},
+	} {
+		if env.file != "" {
+			fileVars, err := sup.LoadEnvFile(env.file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			for _, val := range fileVars {
+				vars.Add(*val)
+			}
+		}
+		for _, val := range env.vars {
+			vars.Add(*val)
+		}
 	}
 	if err := vars.ResolveValues(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -333,13 +551,9 @@ func main() {
 		cliVars.Set(env[:i], env[i+1:])
 	}
 
-	// SUP_ENV is generated only from CLI env vars.
-	// Separate loop to omit duplicates.
-	supEnv := ""
-	for _, v := range cliVars {
-		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
-	}
-	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+	// SUP_ENV is generated only from CLI env vars. It's passed on the command
+	// line, so secrets are left out.
+	vars.Set("SUP_ENV", supEnv(cliVars, vars.Secrets()))
 
 	// Create new Stackup app.
 	app, err := sup.New(conf)
@@ -349,6 +563,18 @@ func main() {
 	}
 	app.Debug(debug)
 	app.Prefix(!disablePrefix)
+	if retryFile == "" {
+		retryFile = path + ".retry"
+	}
+	app.RetryFile(retryFile)
+
+	if subcmd == "shell" {
+		if err := shell(app, network, vars); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Run all the commands in the given network.
 	err = app.Run(network, vars, commands...)
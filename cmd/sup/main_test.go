@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pressly/sup"
+)
+
+// $SUP_ENV passed on to another sup, ie. `sup $SUP_ENV`, splits into
+// clean -e flags of the non-secret vars.
+func TestSupEnv(t *testing.T) {
+	var cliVars sup.EnvList
+	cliVars.Set("FOO", "bar")
+	cliVars.Set("QUOTES", `it's"q"`)
+	cliVars.Set("EMPTY", "")
+	cliVars.Set("REF", "$HOME")
+	cliVars.Set("TOKEN", "s3cr3t")
+
+	var vars sup.EnvList
+	vars.Add(sup.EnvVar{Key: "TOKEN", Value: "s3cr3t", Secret: true})
+	vars.Set("SUP_ENV", supEnv(cliVars, vars.Secrets()))
+	out, err := exec.Command("bash", "-c", vars.AsExport()+` printf '%s\n' $SUP_ENV`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	want := []string{"-e", "FOO=bar", "-e", `QUOTES=it's"q"`, "-e", "EMPTY=", "-e", "REF=$HOME"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("sup $SUP_ENV gets %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// errInterrupted is returned by ReadLine on Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from STDIN. On terminal, it supports basic line
+// editing and history, using `stty` to switch the terminal to raw mode.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+}
+
+func newLineEditor() *lineEditor {
+	return &lineEditor{
+		in:  bufio.NewReader(os.Stdin),
+		out: os.Stdout,
+	}
+}
+
+// ReadLine prints prompt and reads a line, without the line ending.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if !isTerminal(os.Stdin) {
+		line, err := e.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	state, err := stty("-g")
+	if err != nil {
+		return "", err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return "", err
+	}
+	defer stty(state)
+
+	var buf []rune
+	pos := 0
+	hist, saved := len(e.history), ""
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	redraw()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			line := string(buf)
+			if strings.TrimSpace(line) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+				e.history = append(e.history, line)
+			}
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 27: // Escape sequence, ie. arrow keys.
+			if r, _, _ = e.in.ReadRune(); r != '[' && r != 'O' {
+				break
+			}
+			r, _, _ = e.in.ReadRune()
+			switch r {
+			case 'A': // Up
+				if hist > 0 {
+					if hist == len(e.history) {
+						saved = string(buf)
+					}
+					hist--
+					buf = []rune(e.history[hist])
+					pos = len(buf)
+				}
+			case 'B': // Down
+				if hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						buf = []rune(saved)
+					} else {
+						buf = []rune(e.history[hist])
+					}
+					pos = len(buf)
+				}
+			case 'C': // Right
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D': // Left
+				if pos > 0 {
+					pos--
+				}
+			case 'H': // Home
+				pos = 0
+			case 'F': // End
+				pos = len(buf)
+			case '3': // Delete
+				if r, _, _ = e.in.ReadRune(); r == '~' && pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r < 32 {
+				break
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty on STDIN and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
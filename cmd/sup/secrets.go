@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/sup"
+)
+
+var ErrSecretsUsage = errors.New(`Usage: sup secrets keygen
+       sup secrets encrypt FILE
+       sup secrets decrypt FILE
+       sup secrets edit FILE`)
+
+// secrets manages encrypted env files.
+func secrets(args []string) error {
+	if len(args) < 1 {
+		return ErrSecretsUsage
+	}
+
+	if args[0] == "keygen" {
+		return secretsKeygen()
+	}
+
+	if len(args) != 2 {
+		return ErrSecretsUsage
+	}
+	file := args[1]
+
+	key, err := sup.ReadKey()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "encrypt":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if sup.IsEncrypted(data) {
+			return errors.Errorf("%v is already encrypted", file)
+		}
+		return writeEncrypted(file, data, key)
+
+	case "decrypt":
+		data, err := readEncrypted(file, key)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+
+	case "edit":
+		return secretsEdit(file, key)
+
+	default:
+		return ErrSecretsUsage
+	}
+}
+
+// secretsKeygen generates a new local key, unless there's one already.
+func secretsKeygen() error {
+	path := sup.KeyPath()
+	if _, err := os.Stat(path); err == nil {
+		return errors.Errorf("key %v already exists", path)
+	}
+
+	key, err := sup.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, key.Marshal(), 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Key saved to %v\nPublic key: %v\n", path, key.Recipient())
+	return nil
+}
+
+// secretsEdit decrypts file into a private temp file, opens it in $EDITOR
+// and encrypts the result back. Non-existing file is created.
+func secretsEdit(file string, key *sup.Key) error {
+	var data []byte
+	if _, err := os.Stat(file); err == nil {
+		data, err = readEncrypted(file, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "sup-secrets")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$0"`, tmp.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "running editor failed")
+	}
+
+	data, err = ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if _, err := sup.ParseEnvFile(data); err != nil {
+		return errors.Wrap(err, "invalid env file, changes discarded")
+	}
+	return writeEncrypted(file, data, key)
+}
+
+func readEncrypted(file string, key *sup.Key) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !sup.IsEncrypted(data) {
+		return nil, errors.Errorf("%v is not encrypted", file)
+	}
+	return sup.Decrypt(data, key)
+}
+
+func writeEncrypted(file string, data []byte, key *sup.Key) error {
+	encrypted, err := sup.Encrypt(data, key.Public)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, encrypted, 0600)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/sup"
+)
+
+const shellHelp = `Each line is run on the selected hosts in a new shell. Meta-commands:
+  :hosts            List hosts, selected ones are marked with *
+  :select [HOST|N]  Select hosts by name or number, all hosts if none given
+  :only REGEXP      Select hosts matching regexp
+  :serial N         Run on max N hosts at a time, 0 for all at once
+  :help             Show this help
+  :quit             Exit the shell, same as Ctrl-D`
+
+// Max number of lines kept in the history file.
+const shellHistorySize = 1000
+
+// shell runs interactive shell on the network hosts, keeping
+// the connections open between the commands.
+func shell(app *sup.Stackup, network *sup.Network, vars sup.EnvList) error {
+	session, err := app.Connect(network, vars)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.KeepConnections(true)
+
+	hosts := session.Hosts()
+	selected := allHosts(hosts)
+	shellSerial := serial
+
+	editor := newLineEditor()
+	historyPath := shellHistoryPath()
+	editor.history = readShellHistory(historyPath)
+
+	fmt.Fprintf(os.Stderr, "Connected to %v host(s), type :help for help.\n", len(hosts))
+	for {
+		prompt := fmt.Sprintf("%v[%v/%v]> ", network.Name, len(selected), len(hosts))
+		if shellSerial > 0 {
+			prompt = fmt.Sprintf("%v[%v/%v serial %v]> ", network.Name, len(selected), len(hosts), shellSerial)
+		}
+
+		line, err := editor.ReadLine(prompt)
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if isTerminal(os.Stdin) {
+			appendShellHistory(historyPath, line)
+		}
+
+		// Meta-command?
+		if strings.HasPrefix(line, ":") {
+			fields := strings.Fields(line)
+			args := fields[1:]
+			switch fields[0] {
+			case ":hosts":
+				isSelected := map[int]bool{}
+				for _, i := range selected {
+					isSelected[i] = true
+				}
+				for i, host := range hosts {
+					mark := " "
+					if isSelected[i] {
+						mark = "*"
+					}
+					fmt.Fprintf(os.Stderr, "%v %v. %v\n", mark, i+1, host)
+				}
+			case ":select":
+				hostSelection, err := selectHosts(hosts, args)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				selected = hostSelection
+			case ":only":
+				if len(args) != 1 {
+					fmt.Fprintln(os.Stderr, "Usage: :only REGEXP")
+					continue
+				}
+				expr, err := regexp.CompilePOSIX(args[0])
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				var hostSelection []int
+				for i, host := range hosts {
+					if expr.MatchString(host) {
+						hostSelection = append(hostSelection, i)
+					}
+				}
+				if len(hostSelection) == 0 {
+					fmt.Fprintf(os.Stderr, "no hosts match '%v' regexp\n", args[0])
+					continue
+				}
+				selected = hostSelection
+			case ":serial":
+				if len(args) != 1 {
+					fmt.Fprintln(os.Stderr, "Usage: :serial N")
+					continue
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 0 {
+					fmt.Fprintln(os.Stderr, "Usage: :serial N")
+					continue
+				}
+				shellSerial = n
+			case ":help":
+				fmt.Fprintln(os.Stderr, shellHelp)
+			case ":quit", ":exit":
+				return nil
+			default:
+				fmt.Fprintf(os.Stderr, "unknown meta-command %v, type :help for help\n", fields[0])
+			}
+			continue
+		}
+
+		cmd := &sup.Command{
+			Name:   "shell",
+			Run:    line,
+			Serial: shellSerial,
+		}
+		results, err := session.Run(cmd, selected)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		printExitStatuses(results)
+	}
+}
+
+// selectHosts returns indexes of hosts given by name or 1-based number,
+// all the hosts if no args are given.
+func selectHosts(hosts []string, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return allHosts(hosts), nil
+	}
+
+	var selected []int
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n < 1 || n > len(hosts) {
+				return nil, errors.Errorf("no host number %v", n)
+			}
+			selected = append(selected, n-1)
+			continue
+		}
+		found := false
+		for i, host := range hosts {
+			if host == arg {
+				selected = append(selected, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unknown host %v", arg)
+		}
+	}
+	return selected, nil
+}
+
+func allHosts(hosts []string) []int {
+	all := make([]int, len(hosts))
+	for i := range hosts {
+		all[i] = i
+	}
+	return all
+}
+
+// printExitStatuses prints exit status of the command on every host.
+func printExitStatuses(results []sup.HostResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	w := &tabwriter.Writer{}
+	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, result := range results {
+		switch {
+		case result.Err == nil:
+			fmt.Fprintf(w, "%v\texit 0\n", result.Host)
+		case result.ExitStatus >= 0:
+			fmt.Fprintf(w, "%v\texit %v\n", result.Host, result.ExitStatus)
+		default:
+			fmt.Fprintf(w, "%v\t%v\n", result.Host, result.Err)
+		}
+	}
+}
+
+// shellHistoryPath returns path of the shell history file, ~/.sup/history.
+func shellHistoryPath() string {
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(usr.HomeDir, ".sup", "history")
+}
+
+func readShellHistory(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var history []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		history = append(history, scanner.Text())
+	}
+	if len(history) > shellHistorySize {
+		history = history[len(history)-shellHistorySize:]
+	}
+	return history
+}
+
+func appendShellHistory(path, line string) {
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
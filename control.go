@@ -0,0 +1,557 @@
+package sup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ControlDir returns directory of the control sockets of shared
+// connections, ~/.sup/control.
+func ControlDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".sup", "control")
+}
+
+// controlPersist parses control_persist, ie. "10m".
+func (n *Network) controlPersist() (time.Duration, error) {
+	if n.ControlPersist == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(n.ControlPersist)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid control_persist")
+	}
+	return ttl, nil
+}
+
+// controlSocket returns path of the control socket of user@host:port
+// connected through the bastion, if any.
+func controlSocket(host, bastion string) string {
+	sum := sha256.Sum256([]byte(host + "\x00" + bastion))
+	return filepath.Join(ControlDir(), hex.EncodeToString(sum[:10])+".sock")
+}
+
+// controlStarts serializes starting of control masters within the process,
+// ie. of hosts listed twice.
+var controlStarts = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// ConnectControl connects to the host through a control master, a background
+// `sup __control` process sharing its connection with later sup runs until
+// it's idle for ttl. The control master is started if not running yet.
+func (c *SSHClient) ConnectControl(host, bastion string, ttl time.Duration) error {
+	if c.connOpened {
+		return fmt.Errorf("Already connected")
+	}
+
+	initAuthMethodOnce.Do(initAuthMethod)
+
+	if err := c.parseHost(host); err != nil {
+		return err
+	}
+	socket := controlSocket(c.user+"@"+c.host, bastion)
+
+	controlStarts.Lock()
+	mu, ok := controlStarts.m[socket]
+	if !ok {
+		mu = &sync.Mutex{}
+		controlStarts.m[socket] = mu
+	}
+	controlStarts.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	conn, err := c.dialControl(socket)
+	if err != nil {
+		if err := c.startControlMaster(socket, bastion, ttl); err != nil {
+			return ErrConnect{c.user, c.host, "control master: " + err.Error()}
+		}
+		conn, err = c.dialControl(socket)
+		if err != nil {
+			return ErrConnect{c.user, c.host, "control master: " + err.Error()}
+		}
+	}
+	c.conn = conn
+	c.connOpened = true
+
+	// Keepalives are passed on to the host by the control master.
+	c.watch()
+	return nil
+}
+
+// dialControl connects to the control master listening on the socket.
+func (c *SSHClient) dialControl(socket string) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, c.host, &ssh.ClientConfig{User: c.user})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sconn, chans, reqs), nil
+}
+
+// ControlBinary is the sup binary running control masters, set by the sup
+// command to itself. Programs using the package as a library may set it
+// to a sup binary; sup found in PATH is used if empty. The running binary
+// is not used by default, since it's not sup in library use.
+var ControlBinary string
+
+// controlBinary returns the sup binary to run control masters by.
+func controlBinary() (string, error) {
+	if ControlBinary != "" {
+		return ControlBinary, nil
+	}
+	exe, err := exec.LookPath("sup")
+	if err != nil {
+		return "", errors.New("no sup binary to run control master by, see sup.ControlBinary")
+	}
+	return exe, nil
+}
+
+// startControlMaster runs `sup __control` in the background and waits for
+// it to listen on the socket. The control master authenticates by the keys
+// of this process, served as an SSH agent meanwhile, so that encrypted keys
+// don't need to be decrypted again.
+func (c *SSHClient) startControlMaster(socket, bastion string, ttl time.Duration) error {
+	exe, err := controlBinary()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ControlDir(), 0700); err != nil {
+		return err
+	}
+
+	agentSocket, stop, err := serveSigners(append(append([]ssh.Signer{}, c.signers...), authSigners...))
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	logFile := strings.TrimSuffix(socket, ".sock") + ".log"
+	log, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	args := []string{"__control", "-socket", socket, "-ttl", ttl.String()}
+	if bastion != "" {
+		args = append(args, "-bastion", bastion)
+	}
+	if c.proxy != "" {
+		args = append(args, "-proxy", c.proxy)
+	}
+	if c.proxyCommand != "" {
+		args = append(args, "-proxy-command", c.proxyCommand)
+	}
+	if c.aliveInterval > 0 {
+		args = append(args, "-server-alive-interval", c.aliveInterval.String(), "-server-alive-count-max", strconv.Itoa(c.aliveCountMax))
+	}
+	cmd := exec.Command(exe, append(args, c.user+"@"+c.host)...)
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+agentSocket)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // Outlive this process.
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case <-exited:
+			data, _ := ioutil.ReadFile(logFile)
+			return errors.New(strings.TrimSpace(string(data)))
+		case <-timeout:
+			return errors.New("timeout")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// serveSigners serves the signers as an SSH agent on a temporary socket.
+func serveSigners(signers []ssh.Signer) (socket string, stop func(), err error) {
+	dir, err := ioutil.TempDir("", "sup-agent")
+	if err != nil {
+		return "", nil, err
+	}
+	socket = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(signersAgent(signers), conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return socket, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// signersAgent is a read-only SSH agent of signers.
+type signersAgent []ssh.Signer
+
+func (a signersAgent) List() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	for _, signer := range a {
+		pub := signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: pub.Type(), Blob: pub.Marshal()})
+	}
+	return keys, nil
+}
+
+func (a signersAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	for _, signer := range a {
+		if string(signer.PublicKey().Marshal()) == string(key.Marshal()) {
+			return signer.Sign(rand.Reader, data)
+		}
+	}
+	return nil, errors.New("key not found")
+}
+
+func (a signersAgent) Signers() ([]ssh.Signer, error) { return a, nil }
+
+func (a signersAgent) Add(key agent.AddedKey) error   { return errors.New("read-only agent") }
+func (a signersAgent) Remove(key ssh.PublicKey) error { return errors.New("read-only agent") }
+func (a signersAgent) RemoveAll() error               { return errors.New("read-only agent") }
+func (a signersAgent) Lock(passphrase []byte) error   { return errors.New("read-only agent") }
+func (a signersAgent) Unlock(passphrase []byte) error { return errors.New("read-only agent") }
+
+// ServeControl connects to the host, through the bastion and proxy if set,
+// and shares the connection with sup processes connecting to the socket,
+// until it's idle for ttl or the connection is lost. Keepalives are sent
+// every aliveInterval, if non-zero. It's the control master run by `sup __control`.
+func ServeControl(socket, host, bastion, proxy, proxyCommand string, ttl, aliveInterval time.Duration, aliveCountMax int) error {
+	upstream := &SSHClient{aliveInterval: aliveInterval, aliveCountMax: aliveCountMax, proxy: proxy, proxyCommand: proxyCommand}
+	if bastion != "" {
+		b := &SSHClient{aliveInterval: aliveInterval, aliveCountMax: aliveCountMax, proxy: proxy, proxyCommand: proxyCommand}
+		if err := b.Connect(bastion); err != nil {
+			return errors.Wrap(err, "connecting to bastion failed")
+		}
+		defer b.Close()
+		if err := upstream.ConnectWith(host, b.DialThrough); err != nil {
+			return errors.Wrap(err, "connecting to remote host through bastion failed")
+		}
+	} else if err := upstream.Connect(host); err != nil {
+		return errors.Wrap(err, "connecting to remote host failed")
+	}
+	defer upstream.conn.Close()
+
+	// Socket left behind by a dead control master?
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return errors.New("control master is running already")
+	}
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true} // Unix socket in private dir.
+	config.AddHostKey(hostKey)
+
+	m := &controlMaster{upstream: upstream.conn, idle: time.NewTimer(ttl)}
+	go m.handleUpstreamChannels(upstream.conn.HandleChannelOpen("auth-agent@openssh.com"))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn, config, ttl)
+		}
+	}()
+
+	lost := make(chan struct{})
+	go func() {
+		upstream.conn.Wait()
+		close(lost)
+	}()
+	select {
+	case <-m.idle.C:
+		return nil
+	case <-lost:
+		return errors.New("connection lost")
+	}
+}
+
+// controlMaster proxies sessions and forwards of sup processes (clients)
+// to the upstream connection.
+type controlMaster struct {
+	upstream *ssh.Client
+
+	mu      sync.Mutex
+	clients []*ssh.ServerConn // Latest connected last.
+	idle    *time.Timer       // Fires once there are no clients for ttl.
+}
+
+// serve proxies the client's channels and global requests until it
+// disconnects.
+func (m *controlMaster) serve(conn net.Conn, config *ssh.ServerConfig, ttl time.Duration) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	m.mu.Lock()
+	m.clients = append(m.clients, sconn)
+	m.idle.Stop()
+	m.mu.Unlock()
+
+	forwards := map[string]net.Listener{}
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				m.listenRemote(sconn, req, forwards)
+			case "cancel-tcpip-forward":
+				var p remoteForward
+				if err := ssh.Unmarshal(req.Payload, &p); err == nil {
+					if l, ok := forwards[p.address()]; ok {
+						l.Close()
+						delete(forwards, p.address())
+					}
+				}
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+			default:
+				ok, payload, err := m.upstream.SendRequest(req.Type, req.WantReply, req.Payload)
+				if req.WantReply {
+					req.Reply(ok && err == nil, payload)
+				}
+			}
+		}
+		for _, l := range forwards {
+			l.Close()
+		}
+	}()
+	for newCh := range chans {
+		go proxyNewChannel(newCh, m.upstream)
+	}
+
+	m.mu.Lock()
+	for i, client := range m.clients {
+		if client == sconn {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+			break
+		}
+	}
+	if len(m.clients) == 0 {
+		m.idle.Reset(ttl)
+	}
+	m.mu.Unlock()
+}
+
+// remoteForward is the payload of tcpip-forward requests.
+type remoteForward struct {
+	Addr string
+	Port uint32
+}
+
+func (p remoteForward) address() string {
+	return net.JoinHostPort(p.Addr, strconv.Itoa(int(p.Port)))
+}
+
+// listenRemote serves remote port forward requested by the client.
+// The upstream client handles forwarded-tcpip channels by itself, so
+// the forward listens on the upstream and connections it accepts are
+// opened as forwarded-tcpip channels on the requesting client.
+func (m *controlMaster) listenRemote(client ssh.Conn, req *ssh.Request, forwards map[string]net.Listener) {
+	var p remoteForward
+	if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	l, err := m.upstream.Listen("tcp", p.address())
+	if err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		p.Port = uint32(addr.Port)
+	}
+	forwards[p.address()] = l
+	if req.WantReply {
+		var payload []byte
+		if p.Port != 0 {
+			payload = ssh.Marshal(struct{ Port uint32 }{p.Port})
+		}
+		req.Reply(true, payload)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				origin := struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{Addr: p.Addr, Port: p.Port}
+				if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+					origin.OriginAddr, origin.OriginPort = addr.IP.String(), uint32(addr.Port)
+				}
+				ch, reqs, err := client.OpenChannel("forwarded-tcpip", ssh.Marshal(&origin))
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					io.Copy(ch, conn)
+					ch.CloseWrite()
+				}()
+				io.Copy(conn, ch)
+			}()
+		}
+	}()
+}
+
+// handleUpstreamChannels passes channels opened by the remote host,
+// ie. agent forwards, to the latest connected client.
+func (m *controlMaster) handleUpstreamChannels(chans <-chan ssh.NewChannel) {
+	for newCh := range chans {
+		m.mu.Lock()
+		var client ssh.Conn
+		if len(m.clients) > 0 {
+			client = m.clients[len(m.clients)-1]
+		}
+		m.mu.Unlock()
+		if client == nil {
+			newCh.Reject(ssh.ConnectionFailed, "no client connected")
+			continue
+		}
+		go proxyNewChannel(newCh, client)
+	}
+}
+
+// proxyNewChannel opens the same channel on the other connection and pipes
+// them together.
+func proxyNewChannel(newCh ssh.NewChannel, to ssh.Conn) {
+	ch, reqs, err := to.OpenChannel(newCh.ChannelType(), newCh.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newCh.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	from, fromReqs, err := newCh.Accept()
+	if err != nil {
+		ch.Close()
+		return
+	}
+	proxyChannel(from, fromReqs, ch, reqs)
+}
+
+// proxyChannel pipes data and requests of two channels. Each side is closed
+// once the other one is closed and all its data and requests (ie. exit
+// status) were passed on.
+func proxyChannel(a ssh.Channel, aReqs <-chan *ssh.Request, b ssh.Channel, bReqs <-chan *ssh.Request) {
+	pipe := func(dst, src ssh.Channel) *sync.WaitGroup {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			io.Copy(dst, src)
+			wg.Done()
+		}()
+		go func() {
+			io.Copy(dst.Stderr(), src.Stderr())
+			wg.Done()
+		}()
+		go func() {
+			wg.Wait()
+			dst.CloseWrite()
+		}()
+		return &wg
+	}
+	toA, toB := pipe(a, b), pipe(b, a)
+
+	forward := func(dst ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, nil)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		forward(a, bReqs)
+		toA.Wait()
+		a.Close()
+		wg.Done()
+	}()
+	go func() {
+		forward(b, aReqs)
+		toB.Wait()
+		b.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+}
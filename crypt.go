@@ -0,0 +1,179 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Encrypted env files use age-style X25519 encryption: an ephemeral key pair
+// is generated for every file, the AES-256-GCM file key is derived from
+// the X25519 shared secret with the recipient's public key.
+const (
+	encryptedPEMType = "SUP ENCRYPTED FILE"
+	keyPEMType       = "SUP PRIVATE KEY"
+)
+
+// Key is an X25519 key pair used to encrypt and decrypt env files.
+type Key struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+// GenerateKey creates a new random key pair.
+func GenerateKey() (*Key, error) {
+	var key Key
+	if _, err := rand.Read(key.Private[:]); err != nil {
+		return nil, errors.Wrap(err, "generating key failed")
+	}
+	curve25519.ScalarBaseMult(&key.Public, &key.Private)
+	return &key, nil
+}
+
+// ParseKey parses the PEM encoded private key.
+func ParseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keyPEMType || len(block.Bytes) != 32 {
+		return nil, errors.New("invalid sup key")
+	}
+
+	var key Key
+	copy(key.Private[:], block.Bytes)
+	curve25519.ScalarBaseMult(&key.Public, &key.Private)
+	return &key, nil
+}
+
+// Marshal returns the PEM encoded private key.
+func (k *Key) Marshal() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  keyPEMType,
+		Bytes: k.Private[:],
+	})
+}
+
+// Recipient returns the base64 encoded public key.
+func (k *Key) Recipient() string {
+	return base64.StdEncoding.EncodeToString(k.Public[:])
+}
+
+// KeyPath returns the path of the local key, either $SUP_KEY_FILE
+// or ~/.sup/key.
+func KeyPath() string {
+	if path := os.Getenv("SUP_KEY_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".sup", "key")
+}
+
+// ReadKey reads the local key. The $SUP_KEY env var, if set, takes
+// precedence over the key file, which is handy on CI servers.
+func ReadKey() (*Key, error) {
+	if data := os.Getenv("SUP_KEY"); data != "" {
+		return ParseKey([]byte(data))
+	}
+
+	data, err := ioutil.ReadFile(KeyPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sup key failed (see `sup secrets keygen`)")
+	}
+	return ParseKey(data)
+}
+
+// IsEncrypted reports whether data was created by Encrypt.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+encryptedPEMType+"-----"))
+}
+
+// Encrypt encrypts data for the recipient's public key.
+func Encrypt(data []byte, recipient [32]byte) ([]byte, error) {
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := fileCipher(ephemeral.Private, recipient, ephemeral.Public, recipient)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce failed")
+	}
+
+	body := append(ephemeral.Public[:], nonce...)
+	body = aead.Seal(body, nonce, data, nil)
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedPEMType,
+		Headers: map[string]string{
+			"Recipient": base64.StdEncoding.EncodeToString(recipient[:]),
+		},
+		Bytes: body,
+	}), nil
+}
+
+// Decrypt decrypts data encrypted for the given key.
+func Decrypt(data []byte, key *Key) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedPEMType {
+		return nil, errors.New("not an encrypted file")
+	}
+	if recipient := block.Headers["Recipient"]; recipient != "" && recipient != key.Recipient() {
+		return nil, errors.Errorf("file is encrypted for another key (%v)", recipient)
+	}
+
+	if len(block.Bytes) < 32 {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	var ephemeral [32]byte
+	copy(ephemeral[:], block.Bytes[:32])
+
+	aead, err := fileCipher(key.Private, ephemeral, ephemeral, key.Public)
+	if err != nil {
+		return nil, err
+	}
+	body := block.Bytes[32:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	nonce, ciphertext := body[:aead.NonceSize()], body[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("decryption failed, wrong key or corrupted file")
+	}
+	return plaintext, nil
+}
+
+// fileCipher derives the AES-256-GCM cipher from the X25519 shared secret
+// of private and peer keys. Ephemeral and recipient public keys are bound
+// to the derived key.
+func fileCipher(private, peer, ephemeral, recipient [32]byte) (cipher.AEAD, error) {
+	var shared, zero [32]byte
+	curve25519.ScalarMult(&shared, &private, &peer)
+	if shared == zero {
+		return nil, errors.New("invalid public key")
+	}
+
+	h := sha256.New()
+	h.Write([]byte("sup-env-file-v1"))
+	h.Write(shared[:])
+	h.Write(ephemeral[:])
+	h.Write(recipient[:])
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
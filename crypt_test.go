@@ -0,0 +1,132 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("TOKEN=s3cr3t\n"),
+		bytes.Repeat([]byte{0, 1, 2, 255}, 1000),
+	} {
+		encrypted, err := Encrypt(data, key.Public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(encrypted) {
+			t.Errorf("IsEncrypted(%q) = false", encrypted)
+		}
+		if len(data) > 0 && bytes.Contains(encrypted, data) {
+			t.Errorf("encrypted file contains the plaintext")
+		}
+
+		decrypted, err := Decrypt(encrypted, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("Decrypt() = %q, want %q", decrypted, data)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKey(key.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *key {
+		t.Errorf("ParseKey(Marshal()) differs from the key")
+	}
+
+	for _, data := range []string{
+		"",
+		"not a key",
+		string(pem.EncodeToMemory(&pem.Block{Type: keyPEMType, Bytes: []byte("short")})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key.Private[:]})),
+	} {
+		if _, err := ParseKey([]byte(data)); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", data)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Encrypt([]byte("TOKEN=s3cr3t"), key.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decrypt(encrypted, other); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("Decrypt() with another key = %v, want another key error", err)
+	}
+
+	// Without the Recipient header, decryption itself fails.
+	block, _ := pem.Decode(encrypted)
+	delete(block.Headers, "Recipient")
+	if _, err := Decrypt(pem.EncodeToMemory(block), other); err == nil || !strings.Contains(err.Error(), "decryption failed") {
+		t.Errorf("Decrypt() with another key = %v, want decryption failure", err)
+	}
+}
+
+func TestDecryptCorrupted(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Encrypt([]byte("TOKEN=s3cr3t"), key.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(encrypted)
+	body := block.Bytes
+
+	tests := []struct {
+		name string
+		body []byte
+		err  string
+	}{
+		{"empty", nil, "truncated"},
+		{"no nonce", body[:32], "truncated"},
+		{"truncated nonce", body[:40], "truncated"},
+		{"truncated ciphertext", body[:len(body)-1], "decryption failed"},
+		{"modified ciphertext", append(append([]byte{}, body[:len(body)-1]...), body[len(body)-1]^1), "decryption failed"},
+	}
+	for _, tt := range tests {
+		corrupted := pem.EncodeToMemory(&pem.Block{
+			Type:    block.Type,
+			Headers: block.Headers,
+			Bytes:   tt.body,
+		})
+		if _, err := Decrypt(corrupted, key); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: Decrypt() = %v, want %q error", tt.name, err, tt.err)
+		}
+	}
+
+	// Missing PEM footer.
+	truncated := encrypted[:bytes.Index(encrypted, []byte("-----END"))]
+	if _, err := Decrypt(truncated, key); err == nil {
+		t.Errorf("Decrypt() of file without footer succeeded")
+	}
+}
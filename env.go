@@ -0,0 +1,188 @@
+package sup
+
+import (
+	"strings"
+)
+
+// isComputed reports whether the value is computed by a local shell.
+func (e EnvVar) isComputed() bool {
+	if e.isCommand() {
+		return true
+	}
+	for _, part := range splitRefs(e.Value, func(string) bool { return false }) {
+		if part.command {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommand reports whether the whole value is printed by a command,
+// ie. a secret provider or `sh: COMMAND`.
+func (e EnvVar) isCommand() bool {
+	return e.Provider != "" || strings.HasPrefix(e.Value, "sh:")
+}
+
+// commandExpr returns bash expression of the command printing the value.
+func (e EnvVar) commandExpr() string {
+	if e.Provider != "" {
+		return "$(" + e.Provider + ")"
+	}
+	return "$(" + strings.TrimSpace(e.Value[3:]) + ")"
+}
+
+// shellQuote quotes s as a single literal shell word.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// envRef is a part of a value; either literal text, a variable reference
+// or a command substitution.
+type envRef struct {
+	text    string
+	ref     bool
+	command bool
+}
+
+// splitRefs splits value into literal text, `$VAR` or `${VAR}` references
+// to defined variables and `$(COMMAND)` substitutions. References to
+// undefined variables and unclosed substitutions are kept literally
+// and `$$` is a literal `$`.
+func splitRefs(value string, defined func(key string) bool) []envRef {
+	var parts []envRef
+	text := ""
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			text += value[i : i+1]
+			continue
+		}
+		if value[i+1] == '$' {
+			text += "$"
+			i++
+			continue
+		}
+
+		if value[i+1] == '(' {
+			end := commandEnd(value, i+2)
+			if end < 0 {
+				text += value[i : i+1]
+				continue
+			}
+			if text != "" {
+				parts = append(parts, envRef{text: text})
+				text = ""
+			}
+			parts = append(parts, envRef{text: value[i+2 : end], command: true})
+			i = end
+			continue
+		}
+
+		var key string
+		end := i + 1
+		if value[i+1] == '{' {
+			closing := strings.Index(value[i+2:], "}")
+			if closing < 0 {
+				text += value[i : i+1]
+				continue
+			}
+			key = value[i+2 : i+2+closing]
+			end = i + 2 + closing + 1
+		} else {
+			for end < len(value) && isEnvKeyChar(value[end], end == i+1) {
+				end++
+			}
+			key = value[i+1 : end]
+		}
+
+		if key == "" || !defined(key) {
+			text += value[i : i+1]
+			continue
+		}
+		if text != "" {
+			parts = append(parts, envRef{text: text})
+			text = ""
+		}
+		parts = append(parts, envRef{text: key, ref: true})
+		i = end - 1
+	}
+	if text != "" {
+		parts = append(parts, envRef{text: text})
+	}
+	return parts
+}
+
+// commandEnd returns index of the parenthesis closing command substitution
+// starting at start, skipping quoted text and nested parentheses, or -1.
+func commandEnd(value string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote == '\'':
+			if c == quote {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case quote == '"':
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+func isEnvKeyChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// expandRefs replaces variable references in value using lookup.
+func expandRefs(value string, lookup func(key string) (string, bool)) string {
+	defined := func(key string) bool {
+		_, ok := lookup(key)
+		return ok
+	}
+	expanded := ""
+	for _, part := range splitRefs(value, defined) {
+		switch {
+		case part.ref:
+			part.text, _ = lookup(part.text)
+		case part.command:
+			part.text = "$(" + part.text + ")"
+		}
+		expanded += part.text
+	}
+	return expanded
+}
+
+// refsAsShellWord returns value as a shell word, with literal text
+// replaced by the shell words of literal, and variable references and
+// command substitutions left to be expanded by the shell.
+func refsAsShellWord(value string, defined func(key string) bool, literal func(text string) string) string {
+	word := ""
+	for _, part := range splitRefs(value, defined) {
+		switch {
+		case part.ref:
+			word += `"${` + part.text + `}"`
+		case part.command:
+			word += `"$(` + part.text + `)"`
+		default:
+			word += literal(part.text)
+		}
+	}
+	if word == "" {
+		return "''"
+	}
+	return word
+}
@@ -0,0 +1,157 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LoadEnvFile reads environment variables from a dotenv file. Encrypted
+// files (see Encrypt) are decrypted with the local key first and all their
+// variables are marked as secret.
+func LoadEnvFile(path string) (EnvList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading env_file failed")
+	}
+
+	secret := false
+	if IsEncrypted(data) {
+		key, err := ReadKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "decrypting env_file %v failed", path)
+		}
+		data, err = Decrypt(data, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decrypting env_file %v failed", path)
+		}
+		secret = true
+	}
+
+	env, err := ParseEnvFile(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing env_file %v failed", path)
+	}
+	// Values from env files are always literal.
+	for _, v := range env {
+		v.Secret = secret
+		v.resolved = true
+	}
+
+	return env, nil
+}
+
+// ParseEnvFile parses dotenv formatted data, ie. `KEY=VALUE` lines with
+// optional `export` prefix, # comments and single or double quoted values.
+func ParseEnvFile(data []byte) (EnvList, error) {
+	var env EnvList
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments.
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %v: expected KEY=VALUE", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isEnvKey(key) {
+			return nil, fmt.Errorf("line %v: invalid key %q", n, key)
+		}
+		value := strings.TrimSpace(line[i+1:])
+
+		// Multi-line quoted value. Errors point at its first line.
+		start := n
+		for len(value) > 0 && (value[0] == '"' || value[0] == '\'') && !isClosed(value) {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("line %v: unterminated quoted value", start)
+			}
+			n++
+			value += "\n" + scanner.Text()
+		}
+
+		value, err := unquoteEnvValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", start, err)
+		}
+		env.Set(key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// isClosed reports whether a quoted value has its closing quote.
+func isClosed(value string) bool {
+	quote := value[0]
+	for i := 1; i < len(value); i++ {
+		if quote == '"' && value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == quote {
+			return true
+		}
+	}
+	return false
+}
+
+func unquoteEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated quoted value")
+		}
+		return value[1 : end+1], nil
+
+	case '"':
+		var buf bytes.Buffer
+		for i := 1; i < len(value); i++ {
+			switch c := value[i]; c {
+			case '"':
+				return buf.String(), nil
+			case '\\':
+				i++
+				if i == len(value) {
+					return "", errors.New("unterminated quoted value")
+				}
+				switch value[i] {
+				case 'n':
+					buf.WriteByte('\n')
+				case 't':
+					buf.WriteByte('\t')
+				default:
+					buf.WriteByte(value[i])
+				}
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated quoted value")
+	}
+
+	// Unquoted value, strip inline comment.
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
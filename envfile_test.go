@@ -0,0 +1,148 @@
+package sup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# comment
+PLAIN=value
+export EXPORTED=exported
+  SPACED = spaced value
+INLINE=value # comment
+HASH=a#b
+EMPTY=
+SINGLE='it is $HOME # not a comment'
+DOUBLE="tab\there \"quoted\" \\ $HOME"
+ESCAPED_NEWLINE="a\nb"
+MULTI_SINGLE='first
+  second'
+MULTI_DOUBLE="first
+second \" still
+third"
+EQUALS=a=b=c
+
+PLAIN=overridden
+`
+	want := []struct{ key, value string }{
+		{"PLAIN", "overridden"},
+		{"EXPORTED", "exported"},
+		{"SPACED", "spaced value"},
+		{"INLINE", "value"},
+		{"HASH", "a#b"},
+		{"EMPTY", ""},
+		{"SINGLE", "it is $HOME # not a comment"},
+		{"DOUBLE", "tab\there \"quoted\" \\ $HOME"},
+		{"ESCAPED_NEWLINE", "a\nb"},
+		{"MULTI_SINGLE", "first\n  second"},
+		{"MULTI_DOUBLE", "first\nsecond \" still\nthird"},
+		{"EQUALS", "a=b=c"},
+	}
+
+	env, err := ParseEnvFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != len(want) {
+		t.Fatalf("ParseEnvFile() = %v, want %v variables", env, len(want))
+	}
+	for i, v := range env {
+		if v.Key != want[i].key || v.Value != want[i].value {
+			t.Errorf("variable %v = %v=%q, want %v=%q", i, v.Key, v.Value, want[i].key, want[i].value)
+		}
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"NOVALUE", "line 1: expected KEY=VALUE"},
+		{"A=1\n=value", "line 2: expected KEY=VALUE"},
+		{"A=1\nFOO BAR=value", `line 2: invalid key "FOO BAR"`},
+		{"X;touch /tmp/p=value", `line 1: invalid key "X;touch /tmp/p"`},
+		{"1A=value", `line 1: invalid key "1A"`},
+		{"A-B=value", `line 1: invalid key "A-B"`},
+		{"A='unterminated", "line 1: unterminated quoted value"},
+		{"A=\"unterminated\nB=2", "line 1: unterminated quoted value"},
+		{"A=\"escaped\\\"", "line 1: unterminated quoted value"},
+	}
+	for _, tt := range tests {
+		_, err := ParseEnvFile([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseEnvFile(%q) = %v, want %q error", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SUP_KEY", string(key.Marshal()))
+	defer os.Unsetenv("SUP_KEY")
+
+	data := []byte("TOKEN=s3cr3t\nREF=$TOKEN\n")
+	encrypted, err := Encrypt(data, key.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(dir, "plain.env")
+	encryptedPath := filepath.Join(dir, "secret.env")
+	if err := ioutil.WriteFile(plainPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(encryptedPath, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		secret bool
+	}{
+		{plainPath, false},
+		{encryptedPath, true},
+	} {
+		env, err := LoadEnvFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env) != 2 {
+			t.Fatalf("LoadEnvFile(%v) = %v", tt.path, env)
+		}
+		// Values are literal, even after resolving.
+		if err := env.ResolveValues(); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range env {
+			if v.Secret != tt.secret {
+				t.Errorf("%v: %v secret = %v, want %v", tt.path, v.Key, v.Secret, tt.secret)
+			}
+		}
+		if env[0].Value != "s3cr3t" || env[1].Value != "$TOKEN" {
+			t.Errorf("%v: values %q, %q", tt.path, env[0].Value, env[1].Value)
+		}
+	}
+
+	// Encrypted for another key.
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SUP_KEY", string(other.Marshal()))
+	if _, err := LoadEnvFile(encryptedPath); err == nil {
+		t.Errorf("LoadEnvFile() with another key succeeded")
+	}
+}
@@ -0,0 +1,185 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Forward is a port forward of the forward command. Local forward listens
+// on the local address and connects to the remote address from the host,
+// ie. to a DB reachable by the host only. Reverse forward listens on the
+// remote address on the host and connects to the local address.
+type Forward struct {
+	Name    string `yaml:"name"`    // Env var SUP_FORWARD_<NAME> of the local address.
+	Local   string `yaml:"local"`   // Local address, auto-assigned port if empty or 0.
+	Remote  string `yaml:"remote"`  // Remote address as seen by the host.
+	Reverse bool   `yaml:"reverse"` // Remote to local forward.
+}
+
+// envName returns the env var name of the i-th forward, SUP_FORWARD_<NAME>.
+func (f Forward) envName(i int) string {
+	name := f.Name
+	if name == "" {
+		name = strconv.Itoa(i + 1)
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	return "SUP_FORWARD_" + name
+}
+
+// localAddress returns the local address to listen on, ie. "127.0.0.1:0"
+// for auto-assigned port.
+func (f Forward) localAddress() string {
+	switch {
+	case f.Local == "":
+		return "127.0.0.1:0"
+	case strings.Trim(f.Local, "0123456789") == "":
+		return "127.0.0.1:" + f.Local
+	}
+	return f.Local
+}
+
+// forwarder is the host end of port forwards.
+type forwarder interface {
+	dialRemote(addr string) (net.Conn, error)
+	listenRemote(addr string) (net.Listener, error)
+}
+
+func (c *SSHClient) dialRemote(addr string) (net.Conn, error) {
+	return c.conn.Dial("tcp", addr)
+}
+
+func (c *SSHClient) listenRemote(addr string) (net.Listener, error) {
+	return c.conn.Listen("tcp", addr)
+}
+
+func (c *LocalhostClient) dialRemote(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (c *LocalhostClient) listenRemote(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// forward opens port forwards of the command on the clients. The forwards
+// stay open until the session is closed. Local addresses are exported
+// as SUP_FORWARD_<NAME> env vars of the first host, SUP_FORWARD_<NAME>_PORT
+// and SUP_FORWARD_<NAME>_ALL of all the hosts.
+func (s *Session) forward(cmd *Command, clients []Client) ([]HostResult, error) {
+	var results []HostResult
+	addrs := make([][]string, len(cmd.Forward))
+	for _, c := range clients {
+		result := HostResult{Host: s.host(c), client: c}
+		for i, fwd := range cmd.Forward {
+			l, desc, err := s.openForward(c, fwd)
+			if err != nil {
+				result.Err = errors.Wrapf(err, "forward %v", fwd.envName(i))
+				result.ExitStatus = -1
+				break
+			}
+			s.listeners = append(s.listeners, l)
+			fmt.Fprintf(os.Stdout, "%sforwarding %v\n", s.prefix(c), desc)
+			if !fwd.Reverse {
+				addrs[i] = append(addrs[i], l.Addr().String())
+			}
+		}
+		results = append(results, result)
+		if result.Err != nil {
+			return results, nil
+		}
+	}
+
+	for i, fwd := range cmd.Forward {
+		if fwd.Reverse || len(addrs[i]) == 0 {
+			continue
+		}
+		name := fwd.envName(i)
+		_, port, _ := net.SplitHostPort(addrs[i][0])
+		s.vars = append(append(EnvList{}, s.vars...),
+			&EnvVar{Key: name, Value: addrs[i][0], resolved: true},
+			&EnvVar{Key: name + "_PORT", Value: port, resolved: true},
+			&EnvVar{Key: name + "_ALL", Value: strings.Join(addrs[i], " "), resolved: true},
+		)
+	}
+	return results, nil
+}
+
+// openForward opens the forward on the client and returns its listener
+// and description.
+func (s *Session) openForward(c Client, fwd Forward) (net.Listener, string, error) {
+	f, ok := c.(forwarder)
+	if !ok {
+		return nil, "", errors.New("not supported by the host")
+	}
+
+	if fwd.Reverse {
+		l, err := f.listenRemote(fwd.Remote)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "listening on remote %v failed", fwd.Remote)
+		}
+		go serveForward(l, func() (net.Conn, error) {
+			return net.Dial("tcp", fwd.localAddress())
+		})
+		return l, fmt.Sprintf("remote %v -> local %v", l.Addr(), fwd.localAddress()), nil
+	}
+
+	l, err := net.Listen("tcp", fwd.localAddress())
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "listening on local %v failed", fwd.localAddress())
+	}
+	go serveForward(l, func() (net.Conn, error) {
+		return f.dialRemote(fwd.Remote)
+	})
+	return l, fmt.Sprintf("local %v -> remote %v", l.Addr(), fwd.Remote), nil
+}
+
+// serveForward pipes connections accepted by the listener to connections
+// of dial, until the listener is closed.
+func serveForward(l net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, err := dial()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: forwarding connection failed: %v\n", err)
+				return
+			}
+			defer target.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			pipe := func(dst, src net.Conn) {
+				io.Copy(dst, src)
+				if cw, ok := dst.(interface {
+					CloseWrite() error
+				}); ok {
+					cw.CloseWrite()
+				} else {
+					dst.Close()
+				}
+				wg.Done()
+			}
+			go pipe(target, conn)
+			go pipe(conn, target)
+			wg.Wait()
+		}()
+	}
+}
@@ -0,0 +1,296 @@
+package sup
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Import references another Supfile to be merged into this one.
+// Commands and targets of an import with Namespace are available
+// as "namespace:name".
+type Import struct {
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace"`
+}
+
+// UnmarshalYAML accepts either path string or {path, namespace} map.
+func (i *Import) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		i.Path = path
+		return nil
+	}
+
+	type plain Import
+	return unmarshal((*plain)(i))
+}
+
+// resolveImports merges imported Supfiles into conf. Definitions from conf
+// override the imported ones and later imports override earlier ones.
+func (conf *Supfile) resolveImports(dir string, seen map[string]bool) error {
+	if len(conf.Imports) == 0 {
+		return nil
+	}
+
+	var imported Supfile
+	for _, imp := range conf.Imports {
+		if imp.Path == "" {
+			return errors.New("imports: missing path")
+		}
+		path := imp.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrap(err, "imports: "+imp.Path)
+		}
+		if seen[abs] {
+			return errors.Errorf("imports: %v imports itself", imp.Path)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "imports")
+		}
+		seen[abs] = true
+		other, err := newSupfile(data, filepath.Dir(path), seen)
+		delete(seen, abs)
+		if err != nil {
+			return errors.Wrap(err, "imports: "+imp.Path)
+		}
+
+		other.relocate(filepath.Dir(path))
+		if imported.sources == nil {
+			imported.sources = map[string]keySource{}
+		}
+		for key, src := range other.importSources(path, imp.Namespace) {
+			imported.sources[key] = src
+		}
+		if imp.Namespace != "" {
+			other.namespace(imp.Namespace)
+		}
+
+		imported.Networks.merge(other.Networks, true)
+		imported.Commands.merge(other.Commands, true)
+		imported.Targets.merge(other.Targets, true)
+		for _, v := range other.Env {
+			imported.Env.Add(*v)
+		}
+		if other.EnvFile != "" {
+			imported.EnvFile = other.EnvFile
+			src, ok := other.sources["env_file"]
+			if !ok {
+				src = keySource{file: path, key: "env_file"}
+			}
+			imported.sources["env_file"] = src
+		}
+		if other.Proxy != "" || other.ProxyCommand != "" {
+			imported.Proxy, imported.ProxyCommand = other.Proxy, other.ProxyCommand
+		}
+	}
+
+	// Sources of the entries not overridden by conf.
+	conf.sources = map[string]keySource{}
+	for key, src := range imported.sources {
+		if !conf.defines(key) {
+			conf.sources[key] = src
+		}
+	}
+
+	conf.Networks.merge(imported.Networks, false)
+	conf.Commands.merge(imported.Commands, false)
+	conf.Targets.merge(imported.Targets, false)
+	for _, v := range conf.Env {
+		imported.Env.Add(*v)
+	}
+	conf.Env = imported.Env
+	if conf.EnvFile == "" && imported.EnvFile != "" {
+		conf.EnvFile = imported.EnvFile
+		conf.sources["env_file"] = imported.sources["env_file"]
+	}
+	if conf.Proxy == "" && conf.ProxyCommand == "" {
+		conf.Proxy, conf.ProxyCommand = imported.Proxy, imported.ProxyCommand
+	}
+
+	return nil
+}
+
+// keySource is the Supfile and key an imported entry is defined at.
+type keySource struct {
+	file string
+	key  string // Key of the entry, ie. "commands.migrate".
+}
+
+// importSources returns sources of networks, commands and targets of
+// Supfile imported from path, keyed by their keys with namespace ns.
+// Entries it imported itself keep their sources.
+func (conf *Supfile) importSources(path, ns string) map[string]keySource {
+	sources := map[string]keySource{}
+	add := func(kind, name string) {
+		key := kind + "." + name
+		src, ok := conf.sources[key]
+		if !ok {
+			src = keySource{file: path, key: key}
+		}
+		if ns != "" && kind != "networks" {
+			key = kind + "." + ns + ":" + name
+		}
+		sources[key] = src
+	}
+	for _, name := range conf.Networks.Names {
+		add("networks", name)
+	}
+	for _, name := range conf.Commands.Names {
+		add("commands", name)
+	}
+	for _, name := range conf.Targets.Names {
+		add("targets", name)
+	}
+	return sources
+}
+
+// defines reports whether the Supfile itself defines the entry of key,
+// ie. "commands.deploy".
+func (conf *Supfile) defines(key string) bool {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	var ok bool
+	switch parts[0] {
+	case "networks":
+		_, ok = conf.Networks.nets[parts[1]]
+	case "commands":
+		_, ok = conf.Commands.cmds[parts[1]]
+	case "targets":
+		_, ok = conf.Targets.targets[parts[1]]
+	}
+	return ok
+}
+
+// source returns the Supfile and key the key is defined at, if imported.
+// Key is of an entry or its field, ie. "commands.deploy.script".
+func (conf *Supfile) source(key string) (keySource, bool) {
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 2 {
+		return keySource{}, false
+	}
+	src, ok := conf.sources[parts[0]+"."+parts[1]]
+	if ok && len(parts) == 3 {
+		src.key += "." + parts[2]
+	}
+	return src, ok
+}
+
+// relocate makes file paths of an imported Supfile relative to its dir.
+// Entries it imported itself are relocated already.
+func (conf *Supfile) relocate(dir string) {
+	if _, ok := conf.sources["env_file"]; !ok {
+		conf.EnvFile = relocatePath(dir, conf.EnvFile)
+	}
+	for name, network := range conf.Networks.nets {
+		if _, ok := conf.sources["networks."+name]; ok {
+			continue
+		}
+		network.EnvFile = relocatePath(dir, network.EnvFile)
+		network.InventoryFile = relocatePath(dir, network.InventoryFile)
+		network.CertificateFile = relocatePath(dir, network.CertificateFile)
+		conf.Networks.nets[name] = network
+	}
+	for name, cmd := range conf.Commands.cmds {
+		if _, ok := conf.sources["commands."+name]; ok {
+			continue
+		}
+		cmd.Script = relocatePath(dir, cmd.Script)
+		cmd.EnvFile = relocatePath(dir, cmd.EnvFile)
+		uploads := make([]Upload, len(cmd.Upload))
+		for i, upload := range cmd.Upload {
+			upload.Src = relocatePath(dir, upload.Src)
+			uploads[i] = upload
+		}
+		cmd.Upload = uploads
+		conf.Commands.cmds[name] = cmd
+	}
+}
+
+// relocatePath joins relative path with dir. Absolute paths and paths
+// starting with an env var or ~ are kept as they are.
+func relocatePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "$") || strings.HasPrefix(path, "~") {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// namespace prefixes commands and targets with "ns:".
+func (conf *Supfile) namespace(ns string) {
+	cmds := map[string]Command{}
+	for i, name := range conf.Commands.Names {
+		cmds[ns+":"+name] = conf.Commands.cmds[name]
+		conf.Commands.Names[i] = ns + ":" + name
+	}
+	conf.Commands.cmds = cmds
+
+	targets := map[string][]string{}
+	for i, name := range conf.Targets.Names {
+		var target []string
+		for _, cmd := range conf.Targets.targets[name] {
+			target = append(target, ns+":"+cmd)
+		}
+		targets[ns+":"+name] = target
+		conf.Targets.Names[i] = ns + ":" + name
+	}
+	conf.Targets.targets = targets
+}
+
+// merge adds networks from other. Existing networks are replaced
+// only if override is true.
+func (n *Networks) merge(other Networks, override bool) {
+	if n.nets == nil {
+		n.nets = map[string]Network{}
+	}
+	for _, name := range other.Names {
+		if _, ok := n.nets[name]; !ok {
+			n.Names = append(n.Names, name)
+		} else if !override {
+			continue
+		}
+		n.nets[name] = other.nets[name]
+	}
+}
+
+// merge adds commands from other. Existing commands are replaced
+// only if override is true.
+func (c *Commands) merge(other Commands, override bool) {
+	if c.cmds == nil {
+		c.cmds = map[string]Command{}
+	}
+	for _, name := range other.Names {
+		if _, ok := c.cmds[name]; !ok {
+			c.Names = append(c.Names, name)
+		} else if !override {
+			continue
+		}
+		c.cmds[name] = other.cmds[name]
+	}
+}
+
+// merge adds targets from other. Existing targets are replaced
+// only if override is true.
+func (t *Targets) merge(other Targets, override bool) {
+	if t.targets == nil {
+		t.targets = map[string][]string{}
+	}
+	for _, name := range other.Names {
+		if _, ok := t.targets[name]; !ok {
+			t.Names = append(t.Names, name)
+		} else if !override {
+			continue
+		}
+		t.targets[name] = other.targets[name]
+	}
+}
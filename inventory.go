@@ -0,0 +1,293 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InventoryHost is a host printed by inventory command in JSON format.
+type InventoryHost struct {
+	Address string   `json:"address"`
+	User    string   `json:"user"`
+	Port    int      `json:"port"`
+	Tags    []string `json:"tags"`
+}
+
+// UnmarshalJSON accepts either host string or {address, user, port, tags}
+// object. "host" is an alias of "address".
+func (h *InventoryHost) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		h.Address = address
+		return nil
+	}
+
+	type plain InventoryHost
+	var host struct {
+		plain
+		Host string `json:"host"`
+	}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return err
+	}
+	if host.Address == "" {
+		host.Address = host.Host
+	}
+	if host.Address == "" {
+		return errors.New("inventory host with no address")
+	}
+	*h = InventoryHost(host.plain)
+	return nil
+}
+
+// String returns the host as used in Network.Hosts, ie. "user@address:port".
+func (h InventoryHost) String() string {
+	host := h.Address
+	if h.User != "" {
+		host = h.User + "@" + host
+	}
+	if h.Port != 0 {
+		host += ":" + strconv.Itoa(h.Port)
+	}
+	return host
+}
+
+// inventoryOutputs memoizes inventory command outputs, so networks
+// sharing one inventory script run it only once.
+var inventoryOutputs = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: map[string][]byte{}}
+
+// runInventory runs the inventory command, or returns its memoized output.
+// Output is cached on disk for ttl, if non-zero. Cached output is ignored
+// if refresh is true.
+func runInventory(command string, ttl time.Duration, refresh bool) ([]byte, error) {
+	inventoryOutputs.Lock()
+	defer inventoryOutputs.Unlock()
+
+	if output, ok := inventoryOutputs.m[command]; ok {
+		return output, nil
+	}
+
+	cachePath := inventoryCachePath(command)
+	if ttl > 0 && !refresh {
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < ttl {
+			if output, err := ioutil.ReadFile(cachePath); err == nil {
+				inventoryOutputs.m[command] = output
+				return output, nil
+			}
+		}
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	inventoryOutputs.m[command] = output
+
+	if ttl > 0 {
+		if err := writeInventoryCache(cachePath, output); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", errors.Wrap(err, "caching inventory failed"))
+		}
+	}
+	return output, nil
+}
+
+// InventoryCacheDir returns directory of the cached inventory outputs,
+// $XDG_CACHE_HOME/sup/inventory or ~/.cache/sup/inventory.
+func InventoryCacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".cache")
+	}
+	return filepath.Join(dir, "sup", "inventory")
+}
+
+// inventoryCachePath returns cache file of the command. Relative paths
+// in the command depend on the current directory, so it's part of the key.
+func inventoryCachePath(command string) string {
+	cwd, _ := os.Getwd()
+	sum := sha256.Sum256([]byte(cwd + "\x00" + command))
+	return filepath.Join(InventoryCacheDir(), hex.EncodeToString(sum[:]))
+}
+
+func writeInventoryCache(path string, output []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(output); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseInventory parses output of inventory command. The output is either
+// newline-separated list of hosts, JSON list of hosts, or JSON object
+// of network names to lists of hosts, of which the named network is used.
+func parseInventory(network string, output []byte) ([]InventoryHost, error) {
+	trimmed := bytes.TrimSpace(output)
+
+	// JSON list of hosts. Lines of IPv6 hosts, ie. "[::1]:22", start
+	// with "[" as well.
+	if bytes.HasPrefix(trimmed, []byte("[")) && json.Valid(trimmed) {
+		var hosts []InventoryHost
+		if err := json.Unmarshal(trimmed, &hosts); err != nil {
+			return nil, errors.Wrap(err, "parsing inventory JSON failed")
+		}
+		return hosts, nil
+	}
+
+	// JSON object of networks. Network is either a list of hosts,
+	// or {"hosts": [...]} object.
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var networks map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &networks); err != nil {
+			return nil, errors.Wrap(err, "parsing inventory JSON failed")
+		}
+		data, ok := networks[network]
+		if !ok {
+			return nil, fmt.Errorf("inventory has no network %v", network)
+		}
+		var hosts []InventoryHost
+		if err := json.Unmarshal(data, &hosts); err == nil {
+			return hosts, nil
+		}
+		var group struct {
+			Hosts []InventoryHost `json:"hosts"`
+		}
+		if err := json.Unmarshal(data, &group); err != nil {
+			return nil, errors.Wrapf(err, "parsing inventory JSON of network %v failed", network)
+		}
+		return group.Hosts, nil
+	}
+
+	// Newline-separated list of hosts.
+	var hosts []InventoryHost
+	buf := bytes.NewBuffer(output)
+	for {
+		host, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		host = strings.TrimSpace(host)
+		// skip empty lines and comments
+		if host != "" && host[:1] != "#" {
+			hosts = append(hosts, InventoryHost{Address: host})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return hosts, nil
+}
+
+// ResolveInventory reads the inventory file and runs the inventory command,
+// if provided, and appends the hosts, their tags and vars to the network.
+// With inventory_ttl set, the command output is cached on disk; refresh
+// bypasses the cache. Subsequent calls are no-op.
+func (n *Network) ResolveInventory(refresh bool) error {
+	if n.inventoryResolved {
+		return nil
+	}
+
+	if n.InventoryFile != "" {
+		inv, err := readInventoryFile(n.InventoryFile)
+		if err != nil {
+			return errors.Wrapf(err, "network %v: inventory file", n.Name)
+		}
+		group := n.InventoryGroup
+		if group == "" {
+			group = n.Name
+		}
+		entries, err := inv.resolve(group)
+		if err != nil {
+			return errors.Wrapf(err, "network %v: inventory file %v", n.Name, n.InventoryFile)
+		}
+		for _, entry := range entries {
+			n.addHost(entry.host, entry.vars)
+		}
+	}
+
+	if n.Inventory == "" {
+		n.inventoryResolved = true
+		return nil
+	}
+
+	ttl, err := n.inventoryTTL()
+	if err != nil {
+		return errors.Wrapf(err, "network %v", n.Name)
+	}
+	output, err := runInventory(n.Inventory, ttl, refresh)
+	if err != nil {
+		return errors.Wrapf(err, "network %v: inventory failed", n.Name)
+	}
+	hosts, err := parseInventory(n.Name, output)
+	if err != nil {
+		return errors.Wrapf(err, "network %v", n.Name)
+	}
+	n.inventoryResolved = true
+
+	for _, host := range hosts {
+		n.addHost(host, nil)
+	}
+	return nil
+}
+
+// addHost appends host with its tags and vars to the network.
+func (n *Network) addHost(host InventoryHost, vars EnvList) {
+	address := host.String()
+	n.Hosts = append(n.Hosts, address)
+	if len(host.Tags) > 0 {
+		if n.HostTags == nil {
+			n.HostTags = map[string][]string{}
+		}
+		n.HostTags[address] = append(n.HostTags[address], host.Tags...)
+	}
+	if len(vars) > 0 {
+		if n.HostVars == nil {
+			n.HostVars = map[string]EnvList{}
+		}
+		n.HostVars[address] = vars
+	}
+}
+
+// inventoryTTL parses inventory_ttl, ie. "10m".
+func (n *Network) inventoryTTL() (time.Duration, error) {
+	if n.InventoryTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(n.InventoryTTL)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid inventory_ttl")
+	}
+	return ttl, nil
+}
@@ -0,0 +1,557 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// inventoryGroup is a group of hosts in an inventory file.
+type inventoryGroup struct {
+	hosts    []string
+	children []string
+	vars     EnvList
+}
+
+// inventoryFile is an Ansible-style inventory of nested host groups
+// with group and host vars.
+type inventoryFile struct {
+	groups     map[string]*inventoryGroup
+	groupNames []string // In order of appearance.
+	hosts      []string // In order of appearance.
+	hostVars   map[string]EnvList
+}
+
+func newInventoryFile() *inventoryFile {
+	inv := &inventoryFile{
+		groups:   map[string]*inventoryGroup{},
+		hostVars: map[string]EnvList{},
+	}
+	inv.group("all")
+	inv.group("ungrouped")
+	return inv
+}
+
+// group returns the named group, creating it if necessary.
+func (inv *inventoryFile) group(name string) *inventoryGroup {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &inventoryGroup{}
+		inv.groups[name] = g
+		inv.groupNames = append(inv.groupNames, name)
+	}
+	return g
+}
+
+// addHost adds host with its vars to the group.
+func (inv *inventoryFile) addHost(group, host string, vars EnvList) {
+	if _, ok := inv.hostVars[host]; !ok {
+		inv.hosts = append(inv.hosts, host)
+		inv.hostVars[host] = EnvList{}
+	}
+	hostVars := inv.hostVars[host]
+	for _, v := range vars {
+		hostVars.Add(*v)
+	}
+	inv.hostVars[host] = hostVars
+
+	g := inv.group(group)
+	for _, h := range g.hosts {
+		if h == host {
+			return
+		}
+	}
+	g.hosts = append(g.hosts, host)
+}
+
+// addChild adds child group to the group.
+func (inv *inventoryFile) addChild(group, child string) {
+	inv.group(child)
+	g := inv.group(group)
+	for _, c := range g.children {
+		if c == child {
+			return
+		}
+	}
+	g.children = append(g.children, child)
+}
+
+// readInventoryFile reads and parses inventory file in Ansible-style
+// INI, YAML or JSON format.
+func readInventoryFile(path string) (*inventoryFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var inv *inventoryFile
+	if isYAMLInventory(path, data) {
+		inv, err = parseInventoryYAML(data)
+	} else {
+		inv, err = parseInventoryINI(data)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return inv, nil
+}
+
+// isYAMLInventory tells YAML and JSON inventories from INI ones,
+// by extension or by the first line.
+func isYAMLInventory(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml", ".json":
+		return true
+	case ".ini", ".cfg":
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		return line == "---" || line[0] == '{' || (line[0] != '[' && strings.HasSuffix(line, ":"))
+	}
+	return false
+}
+
+// parseInventoryINI parses Ansible-style INI inventory:
+//
+//	web1.example.com
+//
+//	[web]
+//	web[01:03].example.com region=eu-west
+//	web4 ansible_host=10.0.0.4 ansible_user=deploy
+//
+//	[web:vars]
+//	http_port=8080
+//
+//	[production:children]
+//	web
+func parseInventoryINI(data []byte) (*inventoryFile, error) {
+	inv := newInventoryFile()
+	section, kind := "ungrouped", "hosts"
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %v: invalid section %v", i+1, line)
+			}
+			section, kind = line[1:len(line)-1], "hosts"
+			if j := strings.Index(section, ":"); j != -1 {
+				section, kind = section[:j], section[j+1:]
+			}
+			if kind != "hosts" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %v: unknown section type %v", i+1, kind)
+			}
+			inv.group(section)
+			continue
+		}
+
+		switch kind {
+		case "hosts":
+			fields, err := splitInventoryFields(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", i+1, err)
+			}
+			var vars EnvList
+			for _, field := range fields[1:] {
+				eq := strings.Index(field, "=")
+				if eq < 1 {
+					return nil, fmt.Errorf("line %v: expected key=value, got %v", i+1, field)
+				}
+				vars.Set(field[:eq], field[eq+1:])
+			}
+			hosts, err := expandHostPattern(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", i+1, err)
+			}
+			for _, host := range hosts {
+				inv.addHost(section, host, vars)
+			}
+
+		case "children":
+			inv.addChild(section, line)
+
+		case "vars":
+			eq := strings.Index(line, "=")
+			if eq < 1 {
+				return nil, fmt.Errorf("line %v: expected key=value, got %v", i+1, line)
+			}
+			fields, err := splitInventoryFields(line[eq+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", i+1, err)
+			}
+			inv.group(section).vars.Set(strings.TrimSpace(line[:eq]), strings.Join(fields, " "))
+		}
+	}
+
+	inv.removeGroupedFromUngrouped()
+
+	return inv, nil
+}
+
+// splitInventoryFields splits line by whitespace, keeping quoted strings
+// together. The rest of the line after " #" is a comment.
+func splitInventoryFields(line string) ([]string, error) {
+	var fields []string
+	var field bytes.Buffer
+	inField := false
+	var quote rune
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				field.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		case r == '#' && !inField:
+			return fields, nil
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+var hostRangeRe = regexp.MustCompile(`\[([0-9]+):([0-9]+)\]`)
+
+// expandHostPattern expands numeric ranges, ie. "web[01:03]" to "web01",
+// "web02" and "web03".
+func expandHostPattern(pattern string) ([]string, error) {
+	m := hostRangeRe.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}, nil
+	}
+
+	from, to := pattern[m[2]:m[3]], pattern[m[4]:m[5]]
+	start, _ := strconv.Atoi(from)
+	end, _ := strconv.Atoi(to)
+	if start > end {
+		return nil, fmt.Errorf("invalid host range %v", pattern[m[0]:m[1]])
+	}
+	format := "%d"
+	if len(from) > 1 && from[0] == '0' {
+		format = "%0" + strconv.Itoa(len(from)) + "d"
+	}
+
+	var hosts []string
+	for i := start; i <= end; i++ {
+		rest, err := expandHostPattern(pattern[m[1]:])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rest {
+			hosts = append(hosts, pattern[:m[0]]+fmt.Sprintf(format, i)+r)
+		}
+	}
+	return hosts, nil
+}
+
+// parseInventoryYAML parses Ansible-style YAML inventory, where groups have
+// "hosts", "vars" and "children" maps. As JSON is valid YAML, it also parses
+// JSON printed by Ansible dynamic inventory scripts, where "hosts" and
+// "children" are lists and "_meta.hostvars" holds the host vars.
+func parseInventoryYAML(data []byte) (*inventoryFile, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	inv := newInventoryFile()
+	for _, item := range doc {
+		name := fmt.Sprintf("%v", item.Key)
+		if name == "_meta" {
+			for _, meta := range mapItems(item.Value) {
+				if meta.Key != "hostvars" {
+					continue
+				}
+				for _, host := range mapItems(meta.Value) {
+					inv.addHost("ungrouped", fmt.Sprintf("%v", host.Key), inventoryVars(host.Value))
+				}
+			}
+			continue
+		}
+		if err := inv.parseYAMLGroup(name, item.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hosts with vars only in _meta belong to some other group.
+	inv.removeGroupedFromUngrouped()
+
+	return inv, nil
+}
+
+func (inv *inventoryFile) parseYAMLGroup(name string, value interface{}) error {
+	inv.group(name)
+
+	// Group as a plain list of hosts.
+	if list, ok := value.([]interface{}); ok {
+		for _, host := range list {
+			inv.addHost(name, fmt.Sprintf("%v", host), nil)
+		}
+		return nil
+	}
+
+	for _, item := range mapItems(value) {
+		switch item.Key {
+		case "hosts":
+			if list, ok := item.Value.([]interface{}); ok {
+				for _, host := range list {
+					inv.addHost(name, fmt.Sprintf("%v", host), nil)
+				}
+				continue
+			}
+			for _, host := range mapItems(item.Value) {
+				patterns, err := expandHostPattern(fmt.Sprintf("%v", host.Key))
+				if err != nil {
+					return err
+				}
+				for _, pattern := range patterns {
+					inv.addHost(name, pattern, inventoryVars(host.Value))
+				}
+			}
+
+		case "vars":
+			g := inv.group(name)
+			for _, v := range inventoryVars(item.Value) {
+				g.vars.Add(*v)
+			}
+
+		case "children":
+			if list, ok := item.Value.([]interface{}); ok {
+				for _, child := range list {
+					inv.addChild(name, fmt.Sprintf("%v", child))
+				}
+				continue
+			}
+			for _, child := range mapItems(item.Value) {
+				childName := fmt.Sprintf("%v", child.Key)
+				inv.addChild(name, childName)
+				if err := inv.parseYAMLGroup(childName, child.Value); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return fmt.Errorf("group %v: unknown key %v", name, item.Key)
+		}
+	}
+	return nil
+}
+
+// inventoryVars converts YAML map to env vars. Only scalar values are kept.
+func inventoryVars(value interface{}) EnvList {
+	var vars EnvList
+	for _, item := range mapItems(value) {
+		switch item.Value.(type) {
+		case yaml.MapSlice, []yaml.MapItem, []interface{}:
+			continue
+		case nil:
+			vars.Set(fmt.Sprintf("%v", item.Key), "")
+		default:
+			vars.Set(fmt.Sprintf("%v", item.Key), fmt.Sprintf("%v", item.Value))
+		}
+	}
+	return vars
+}
+
+// removeGroupedFromUngrouped keeps only hosts with no other group
+// in the "ungrouped" group.
+func (inv *inventoryFile) removeGroupedFromUngrouped() {
+	ungrouped := inv.groups["ungrouped"]
+	var hosts []string
+	for _, host := range ungrouped.hosts {
+		if !inv.isGrouped(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	ungrouped.hosts = hosts
+}
+
+// isGrouped tells if host belongs to a group other than "all" and "ungrouped".
+func (inv *inventoryFile) isGrouped(host string) bool {
+	for name, g := range inv.groups {
+		if name == "all" || name == "ungrouped" {
+			continue
+		}
+		for _, h := range g.hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// members returns hosts of the group and its descendant groups.
+func (inv *inventoryFile) members(group string) []string {
+	if group == "all" {
+		return inv.hosts
+	}
+
+	var hosts []string
+	seen := map[string]bool{}
+	visited := map[string]bool{}
+	var walk func(name string)
+	walk = func(name string) {
+		if visited[name] {
+			return // Cycle.
+		}
+		visited[name] = true
+		g := inv.groups[name]
+		for _, host := range g.hosts {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+		for _, child := range g.children {
+			walk(child)
+		}
+	}
+	walk(group)
+	return hosts
+}
+
+// depth returns the length of the longest chain of parent groups.
+func (inv *inventoryFile) depth(group string, visiting map[string]bool) int {
+	if group == "all" || visiting[group] {
+		return 0
+	}
+	visiting[group] = true
+	defer delete(visiting, group)
+
+	depth := 1
+	for name, g := range inv.groups {
+		for _, child := range g.children {
+			if child == group {
+				if d := inv.depth(name, visiting) + 1; d > depth {
+					depth = d
+				}
+			}
+		}
+	}
+	return depth
+}
+
+// inventoryEntry is a resolved host of an inventory file.
+type inventoryEntry struct {
+	host   InventoryHost
+	groups []string
+	vars   EnvList
+}
+
+// resolve returns hosts of the group with their groups and vars. Vars of
+// parent groups are overridden by vars of child groups and host vars.
+// Ansible connection vars, ie. ansible_host, are used for the host address.
+func (inv *inventoryFile) resolve(group string) ([]inventoryEntry, error) {
+	if _, ok := inv.groups[group]; !ok {
+		return nil, fmt.Errorf("no group %v", group)
+	}
+
+	// Groups ordered by depth, so child group vars take precedence.
+	groupNames := append([]string{}, inv.groupNames...)
+	depths := map[string]int{}
+	for _, name := range groupNames {
+		depths[name] = inv.depth(name, map[string]bool{})
+	}
+	sort.SliceStable(groupNames, func(i, j int) bool {
+		return depths[groupNames[i]] < depths[groupNames[j]]
+	})
+	members := map[string]map[string]bool{}
+	for _, name := range groupNames {
+		members[name] = map[string]bool{}
+		for _, host := range inv.members(name) {
+			members[name][host] = true
+		}
+	}
+
+	var entries []inventoryEntry
+	for _, name := range inv.members(group) {
+		entry := inventoryEntry{host: InventoryHost{Address: name}}
+
+		var vars EnvList
+		for _, g := range groupNames {
+			if g != "all" && !members[g][name] {
+				continue
+			}
+			if g != "all" && g != "ungrouped" {
+				entry.groups = append(entry.groups, g)
+			}
+			for _, v := range inv.groups[g].vars {
+				vars.Add(*v)
+			}
+		}
+		for _, v := range inv.hostVars[name] {
+			vars.Add(*v)
+		}
+
+		for _, v := range vars {
+			switch v.Key {
+			case "ansible_host", "ansible_ssh_host":
+				entry.host.Address = v.Value
+			case "ansible_user", "ansible_ssh_user":
+				entry.host.User = v.Value
+			case "ansible_port", "ansible_ssh_port":
+				port, err := strconv.Atoi(v.Value)
+				if err != nil {
+					return nil, fmt.Errorf("host %v: invalid %v %v", name, v.Key, v.Value)
+				}
+				entry.host.Port = port
+			default:
+				if !strings.HasPrefix(v.Key, "ansible_") && isEnvKey(v.Key) {
+					entry.vars = append(entry.vars, v)
+				}
+			}
+		}
+		entry.host.Tags = entry.groups
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isEnvKey tells if key is a valid env var name.
+func isEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isEnvKeyChar(key[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
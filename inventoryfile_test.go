@@ -0,0 +1,270 @@
+package sup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// entryStrings formats the resolved hosts as "host tags vars", ie.
+// "deploy@10.0.0.3:2222 production,web region=eu", leaving out empty
+// tags and vars.
+func entryStrings(entries []inventoryEntry) []string {
+	var list []string
+	for _, entry := range entries {
+		var vars []string
+		for _, v := range entry.vars {
+			vars = append(vars, v.String())
+		}
+		fields := []string{entry.host.String()}
+		for _, field := range []string{strings.Join(entry.host.Tags, ","), strings.Join(vars, ",")} {
+			if field != "" {
+				fields = append(fields, field)
+			}
+		}
+		list = append(list, strings.Join(fields, " "))
+	}
+	return list
+}
+
+// testInventory checks the hosts resolved for each group of the inventory.
+func testInventory(t *testing.T, inv *inventoryFile, groups map[string][]string) {
+	for group, want := range groups {
+		entries, err := inv.resolve(group)
+		if err != nil {
+			t.Errorf("resolve(%v): %v", group, err)
+			continue
+		}
+		if got := entryStrings(entries); !reflect.DeepEqual(got, want) {
+			t.Errorf("resolve(%v) =\n%q\nwant\n%q", group, got, want)
+		}
+	}
+}
+
+func TestParseInventoryINI(t *testing.T) {
+	data := `# comment
+; comment
+bastion.example.com
+
+[web]
+web[01:02].example.com region=eu-west
+web3 ansible_host=10.0.0.3 ansible_port=2222 ansible_user=deploy region="us east" # comment
+
+[db]
+db1 ansible_ssh_host=10.0.1.1 bad-key=ignored
+
+[web:vars]
+http_port=8080
+region = default
+
+[production:children]
+web
+db
+
+[production:vars]
+http_port=80
+env=production
+`
+	inv, err := parseInventoryINI([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testInventory(t, inv, map[string][]string{
+		"production": {
+			"web01.example.com production,web http_port=8080,env=production,region=eu-west",
+			"web02.example.com production,web http_port=8080,env=production,region=eu-west",
+			"deploy@10.0.0.3:2222 production,web http_port=8080,env=production,region=us east",
+			"10.0.1.1 production,db http_port=80,env=production",
+		},
+		"web": {
+			"web01.example.com production,web http_port=8080,env=production,region=eu-west",
+			"web02.example.com production,web http_port=8080,env=production,region=eu-west",
+			"deploy@10.0.0.3:2222 production,web http_port=8080,env=production,region=us east",
+		},
+		"db": {
+			"10.0.1.1 production,db http_port=80,env=production",
+		},
+		"ungrouped": {
+			"bastion.example.com",
+		},
+		"all": {
+			"bastion.example.com",
+			"web01.example.com production,web http_port=8080,env=production,region=eu-west",
+			"web02.example.com production,web http_port=8080,env=production,region=eu-west",
+			"deploy@10.0.0.3:2222 production,web http_port=8080,env=production,region=us east",
+			"10.0.1.1 production,db http_port=80,env=production",
+		},
+	})
+
+	if _, err := inv.resolve("nothing"); err == nil || err.Error() != "no group nothing" {
+		t.Errorf("resolve(nothing) = %v, want no group error", err)
+	}
+}
+
+func TestParseInventoryINIErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"[web\nhost", "line 1: invalid section [web"},
+		{"host\n\n[web:foo]", "line 3: unknown section type foo"},
+		{"[web]\nhost1\nhost2 novalue", "line 3: expected key=value, got novalue"},
+		{"[web]\nhost1 =value", "line 2: expected key=value, got =value"},
+		{"[web:vars]\n# comment\nnovalue", "line 3: expected key=value, got novalue"},
+		{"[web:vars]\nkey='unterminated", "line 2: unterminated quote"},
+		{"[web]\nhost 'unterminated", "line 2: unterminated quote"},
+		{"[web]\nweb[3:1]", "line 2: invalid host range [3:1]"},
+	}
+	for _, tt := range tests {
+		_, err := parseInventoryINI([]byte(tt.data))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("parseInventoryINI(%q) = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+
+	// Invalid connection vars are reported by resolve.
+	inv, err := parseInventoryINI([]byte("[web]\nweb1 ansible_port=ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.resolve("web"); err == nil || err.Error() != "host web1: invalid ansible_port ssh" {
+		t.Errorf("resolve(web) = %v, want invalid ansible_port error", err)
+	}
+}
+
+func TestExpandHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		hosts   []string
+		err     string
+	}{
+		{pattern: "web", hosts: []string{"web"}},
+		{pattern: "web[1:3]", hosts: []string{"web1", "web2", "web3"}},
+		{pattern: "web[01:03].example.com", hosts: []string{"web01.example.com", "web02.example.com", "web03.example.com"}},
+		{pattern: "web[8:10]", hosts: []string{"web8", "web9", "web10"}},
+		{pattern: "web[2:2]", hosts: []string{"web2"}},
+		{pattern: "r[1:2]n[0:1]", hosts: []string{"r1n0", "r1n1", "r2n0", "r2n1"}},
+		{pattern: "web[a:c]", hosts: []string{"web[a:c]"}},
+		{pattern: "web[3:1]", err: "invalid host range [3:1]"},
+		{pattern: "r[1:2]n[1:0]", err: "invalid host range [1:0]"},
+	}
+	for _, tt := range tests {
+		hosts, err := expandHostPattern(tt.pattern)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expandHostPattern(%q) = %v, want %q error", tt.pattern, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("expandHostPattern(%q) = %q, %v, want %q", tt.pattern, hosts, err, tt.hosts)
+		}
+	}
+}
+
+func TestParseInventoryYAML(t *testing.T) {
+	data := `all:
+  hosts:
+    bastion.example.com:
+  vars:
+    env: production
+  children:
+    web:
+      hosts:
+        web[01:02].example.com:
+          region: eu-west
+        web3:
+          ansible_host: 10.0.0.3
+          ansible_port: 2222
+          ansible_user: deploy
+          list: [ignored]
+      vars:
+        http_port: 8080
+        region: default
+    db:
+      hosts:
+        db1:
+          ansible_host: 10.0.1.1
+`
+	inv, err := parseInventoryYAML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testInventory(t, inv, map[string][]string{
+		"web": {
+			"web01.example.com web env=production,http_port=8080,region=eu-west",
+			"web02.example.com web env=production,http_port=8080,region=eu-west",
+			"deploy@10.0.0.3:2222 web env=production,http_port=8080,region=default",
+		},
+		"db": {
+			"10.0.1.1 db env=production",
+		},
+		"all": {
+			"bastion.example.com env=production",
+			"web01.example.com web env=production,http_port=8080,region=eu-west",
+			"web02.example.com web env=production,http_port=8080,region=eu-west",
+			"deploy@10.0.0.3:2222 web env=production,http_port=8080,region=default",
+			"10.0.1.1 db env=production",
+		},
+		"ungrouped": nil,
+	})
+}
+
+// JSON printed by Ansible dynamic inventory scripts.
+func TestParseInventoryJSON(t *testing.T) {
+	data := `{
+  "_meta": {"hostvars": {"web1": {"ansible_host": "10.0.0.1"}, "db1": {"role": "primary"}}},
+  "web": {"hosts": ["web1", "web2"], "vars": {"http_port": 80}},
+  "db": ["db1"],
+  "production": {"children": ["web", "db"]}
+}`
+	inv, err := parseInventoryYAML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testInventory(t, inv, map[string][]string{
+		"production": {
+			"10.0.0.1 production,web http_port=80",
+			"web2 production,web http_port=80",
+			"db1 production,db role=primary",
+		},
+		"ungrouped": nil,
+	})
+}
+
+func TestParseInventoryYAMLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		err  string
+	}{
+		{"web:\n  host:\n    - web1", "group web: unknown key host"},
+		{"all:\n  children:\n    web:\n      hosts:\n        web[2:1]:", "invalid host range [2:1]"},
+		{"web: [", "yaml: line 1: did not find expected node content"},
+	} {
+		_, err := parseInventoryYAML([]byte(tt.data))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("parseInventoryYAML(%q) = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestIsYAMLInventory(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		data string
+		yaml bool
+	}{
+		{"hosts.yml", "[web]", true},
+		{"hosts.json", "", true},
+		{"hosts.ini", "all:", false},
+		{"hosts", "# comment\n\n[web]\nweb1", false},
+		{"hosts", "web1\nweb2", false},
+		{"hosts", "; comment\nall:\n  hosts:", true},
+		{"hosts", "---\nall:", true},
+		{"hosts", `{"web": ["web1"]}`, true},
+	} {
+		if yaml := isYAMLInventory(tt.path, []byte(tt.data)); yaml != tt.yaml {
+			t.Errorf("isYAMLInventory(%v, %q) = %v, want %v", tt.path, tt.data, yaml, tt.yaml)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package sup
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// serverAlive parses server_alive_interval, ie. "30s" or 30 seconds,
+// and server_alive_count_max, 3 by default.
+func (n *Network) serverAlive() (time.Duration, int, error) {
+	if n.ServerAliveInterval == "" {
+		return 0, 0, nil
+	}
+	interval, err := time.ParseDuration(n.ServerAliveInterval)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(n.ServerAliveInterval)
+		if atoiErr != nil {
+			return 0, 0, errors.Wrap(err, "invalid server_alive_interval")
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	countMax := n.ServerAliveCountMax
+	if countMax < 0 {
+		return 0, 0, errors.New("invalid server_alive_count_max")
+	}
+	if countMax == 0 {
+		countMax = 3
+	}
+	return interval, countMax, nil
+}
+
+// keepAlive sends keepalive@openssh.com requests every interval and
+// closes the connection once countMax of them in a row got no reply,
+// so that the running session fails with "connection lost" instead
+// of waiting forever.
+func (c *SSHClient) keepAlive(conn ssh.Conn, closed <-chan struct{}, interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	replied := make(chan struct{}, 1)
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-replied:
+			missed = 0
+		case <-ticker.C:
+			if missed >= countMax {
+				c.lostMu.Lock()
+				c.lost = true
+				c.lostMu.Unlock()
+				conn.Close()
+				return
+			}
+			missed++
+			go func() {
+				// Any reply will do, even a failure.
+				if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					select {
+					case replied <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+}
+
+// watch notes when the connection closes and starts keepalives,
+// if configured.
+func (c *SSHClient) watch() {
+	conn, closed := c.conn, make(chan struct{})
+	c.closed = closed
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+	if c.aliveInterval > 0 {
+		go c.keepAlive(conn, closed, c.aliveInterval, c.aliveCountMax)
+	}
+}
+
+// lostError returns error of the connection lost during a session, or nil
+// if it's still open. Connection of a control master closes without
+// the reason, once the control master loses its connection.
+func (c *SSHClient) lostError() error {
+	if c.closed == nil {
+		return nil
+	}
+	select {
+	case <-c.closed:
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+	c.lostMu.Lock()
+	defer c.lostMu.Unlock()
+	if c.killed {
+		return errors.New("interrupted")
+	}
+	if c.lost {
+		return fmt.Errorf("connection lost, no reply to %v keepalives", c.aliveCountMax)
+	}
+	return errors.New("connection lost")
+}
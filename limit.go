@@ -0,0 +1,181 @@
+package sup
+
+import (
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Limit filters the network hosts by a limit expression of patterns
+// separated by ":" or ",", ie. "web:&eu-west:!canary". Hosts matching any
+// plain pattern are selected (all hosts if there's none), then narrowed down
+// to hosts matching every "&pattern" and hosts matching any "!pattern"
+// are left out.
+//
+// Pattern matches host tags, the network name, "all", hosts listed in
+// "@file" (one per line, ie. a retry file), "~regexp" or host glob,
+// ie. "web*.example.com". Separators within a pattern, ie. in "~regexp",
+// are escaped by a backslash, ie. "~^db(\:2222)?$".
+func (n *Network) Limit(expr string) error {
+	type matcher func(host string) bool
+	var include, intersect, exclude []matcher
+
+	for _, pattern := range splitLimit(expr) {
+		list := &include
+		switch pattern[0] {
+		case '&':
+			list, pattern = &intersect, pattern[1:]
+		case '!':
+			list, pattern = &exclude, pattern[1:]
+		}
+		if pattern == "" {
+			return errors.Errorf("invalid --limit %q", expr)
+		}
+		m, err := n.hostMatcher(pattern)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, m)
+	}
+
+	var hosts []string
+	for _, host := range n.Hosts {
+		ok := len(include) == 0
+		for _, m := range include {
+			if m(host) {
+				ok = true
+				break
+			}
+		}
+		for _, m := range intersect {
+			ok = ok && m(host)
+		}
+		for _, m := range exclude {
+			ok = ok && !m(host)
+		}
+		if ok {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return errors.Errorf("no hosts match --limit '%v'", expr)
+	}
+	n.KeepHosts(hosts)
+	return nil
+}
+
+// KeepHosts narrows the network hosts down to the given ones, ie. by --only
+// flag. Upload templates still list all the hosts, see AllHosts.
+func (n *Network) KeepHosts(hosts []string) {
+	if n.allHosts == nil {
+		n.allHosts = n.Hosts
+	}
+	n.Hosts = hosts
+}
+
+// AllHosts returns the network hosts, including the ones left out by
+// KeepHosts.
+func (n *Network) AllHosts() []string {
+	if n.allHosts == nil {
+		return n.Hosts
+	}
+	return n.allHosts
+}
+
+// hostMatcher returns matcher of a single limit pattern.
+func (n *Network) hostMatcher(pattern string) (func(host string) bool, error) {
+	switch {
+	case pattern == "all" || pattern == "*" || pattern == n.Name:
+		return func(string) bool { return true }, nil
+
+	case pattern[0] == '~':
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "--limit")
+		}
+		return re.MatchString, nil
+
+	case pattern[0] == '@':
+		data, err := ioutil.ReadFile(pattern[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "--limit")
+		}
+		listed := map[string]bool{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				listed[line] = true
+			}
+		}
+		return func(host string) bool { return listed[host] }, nil
+	}
+
+	return func(host string) bool {
+		for _, tag := range n.HostTags[host] {
+			if tag == pattern {
+				return true
+			}
+		}
+		for _, name := range []string{host, hostAddress(host)} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// splitLimit splits limit expression into patterns. As ":" is also
+// a separator, numeric parts are kept with the previous one as a port,
+// ie. "10.0.0.1:2222". Separators escaped by a backslash are kept in the
+// pattern, ie. "~^db[0-9]+\:22$".
+func splitLimit(expr string) []string {
+	var patterns []string
+	for _, part := range splitEscaped(expr, ',') {
+		var prev string
+		for _, pattern := range splitEscaped(part, ':') {
+			if prev != "" && pattern != "" && strings.Trim(pattern, "0123456789") == "" {
+				patterns[len(patterns)-1] += ":" + pattern
+				continue
+			}
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+			prev = pattern
+		}
+	}
+	return patterns
+}
+
+// splitEscaped splits s by sep, except for sep escaped by a backslash,
+// which is unescaped.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	part := ""
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			part += string(sep)
+			i++
+		case s[i] == sep:
+			parts = append(parts, part)
+			part = ""
+		default:
+			part += s[i : i+1]
+		}
+	}
+	return append(parts, part)
+}
+
+// hostAddress strips user and port of a host, ie. "user@host:22" to "host".
+func hostAddress(host string) string {
+	if at := strings.LastIndex(host, "@"); at != -1 {
+		host = host[at+1:]
+	}
+	if colon := strings.LastIndex(host, ":"); colon != -1 && strings.Count(host, ":") == 1 {
+		host = host[:colon]
+	}
+	return host
+}
@@ -0,0 +1,140 @@
+package sup
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitLimit(t *testing.T) {
+	tests := []struct {
+		expr     string
+		patterns []string
+	}{
+		{"", nil},
+		{"web", []string{"web"}},
+		{"web:&eu-west:!canary", []string{"web", "&eu-west", "!canary"}},
+		{"web, db ,,cache:", []string{"web", "db", "cache"}},
+		{"10.0.0.1:2222", []string{"10.0.0.1:2222"}},
+		{"10.0.0.1:2222:web:22", []string{"10.0.0.1:2222", "web:22"}},
+		{"10.0.0.1,2222", []string{"10.0.0.1", "2222"}},
+		{"2222:web", []string{"2222", "web"}},
+		{"user@host:22:!user@other:2222", []string{"user@host:22", "!user@other:2222"}},
+		{`~^db[0-9]+\:2222$`, []string{"~^db[0-9]+:2222$"}},
+		{`~^db(\:22)?$:web`, []string{"~^db(:22)?$", "web"}},
+		{`~^db[0-9]{1\,2}$,web`, []string{"~^db[0-9]{1,2}$", "web"}},
+		{`~^db\d+$`, []string{`~^db\d+$`}},
+		{`@dir\:name/retry`, []string{"@dir:name/retry"}},
+	}
+	for _, tt := range tests {
+		if patterns := splitLimit(tt.expr); !reflect.DeepEqual(patterns, tt.patterns) {
+			t.Errorf("splitLimit(%q) = %q, want %q", tt.expr, patterns, tt.patterns)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	retry, err := ioutil.TempFile("", "sup-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(retry.Name())
+	retry.WriteString("web2.eu.example.com\n\n  db1.us.example.com:2222  \n")
+	retry.Close()
+
+	hosts := []string{
+		"web1.eu.example.com",
+		"web2.eu.example.com",
+		"deploy@web3.us.example.com",
+		"db1.eu.example.com",
+		"db1.us.example.com:2222",
+		"10.0.0.1:2222",
+	}
+	tags := map[string][]string{
+		"web1.eu.example.com":        {"web", "eu-west"},
+		"web2.eu.example.com":        {"web", "eu-west", "canary"},
+		"deploy@web3.us.example.com": {"web", "us-east"},
+		"db1.eu.example.com":         {"db", "eu-west"},
+		"db1.us.example.com:2222":    {"db", "us-east"},
+	}
+
+	tests := []struct {
+		expr  string
+		hosts []int // Indexes of the selected hosts.
+		err   string
+	}{
+		{expr: "web", hosts: []int{0, 1, 2}},
+		{expr: "web:db", hosts: []int{0, 1, 2, 3, 4}},
+		{expr: "web,db", hosts: []int{0, 1, 2, 3, 4}},
+		{expr: "web:&eu-west", hosts: []int{0, 1}},
+		{expr: "web:&eu-west:!canary", hosts: []int{0}},
+		{expr: "&eu-west:&db", hosts: []int{3}},
+		{expr: "!web", hosts: []int{3, 4, 5}},
+		{expr: "all:!db", hosts: []int{0, 1, 2, 5}},
+		{expr: "production", hosts: []int{0, 1, 2, 3, 4, 5}},
+		{expr: "*", hosts: []int{0, 1, 2, 3, 4, 5}},
+		{expr: "web*", hosts: []int{0, 1, 2}},
+		{expr: "*.us.example.com", hosts: []int{2, 4}},
+		{expr: "deploy@web3.us.example.com", hosts: []int{2}},
+		{expr: "db1.us.example.com:2222", hosts: []int{4}},
+		{expr: "10.0.0.1:2222", hosts: []int{5}},
+		{expr: "10.0.0.1", hosts: []int{5}},
+		{expr: "~^web[12]", hosts: []int{0, 1}},
+		{expr: `~\:2222$`, hosts: []int{4, 5}},
+		{expr: `~^db.*\:2222$`, hosts: []int{4}},
+		{expr: `~\.(eu|us)\.:!~^db`, hosts: []int{0, 1, 2}},
+		{expr: "@" + retry.Name(), hosts: []int{1, 4}},
+		{expr: "web:!@" + retry.Name(), hosts: []int{0, 2}},
+		{expr: "nothing", err: "no hosts match"},
+		{expr: "web:&db", err: "no hosts match"},
+		{expr: "web:!", err: "invalid --limit"},
+		{expr: "~[", err: "--limit"},
+		{expr: "@/nonexistent/retry", err: "--limit"},
+	}
+	for _, tt := range tests {
+		network := Network{
+			Name:     "production",
+			Hosts:    hosts,
+			HostTags: tags,
+		}
+		err := network.Limit(tt.expr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Limit(%q) = %v, want %q error", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Limit(%q): %v", tt.expr, err)
+			continue
+		}
+		var want []string
+		for _, i := range tt.hosts {
+			want = append(want, hosts[i])
+		}
+		if !reflect.DeepEqual(network.Hosts, want) {
+			t.Errorf("Limit(%q) = %q, want %q", tt.expr, network.Hosts, want)
+		}
+		if !reflect.DeepEqual(network.AllHosts(), hosts) {
+			t.Errorf("Limit(%q): AllHosts() = %q", tt.expr, network.AllHosts())
+		}
+	}
+}
+
+func TestKeepHosts(t *testing.T) {
+	network := Network{Hosts: []string{"a", "b", "c"}}
+	if hosts := network.AllHosts(); !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("AllHosts() = %q", hosts)
+	}
+
+	network.KeepHosts([]string{"a", "c"})
+	network.KeepHosts([]string{"c"})
+	if !reflect.DeepEqual(network.Hosts, []string{"c"}) {
+		t.Errorf("Hosts = %q, want [c]", network.Hosts)
+	}
+	if hosts := network.AllHosts(); !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("AllHosts() = %q, want all the hosts", hosts)
+	}
+}
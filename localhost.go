@@ -19,6 +19,7 @@ type LocalhostClient struct {
 	stderr  io.Reader
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+	secrets EnvList
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -38,9 +39,18 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return fmt.Errorf("Command already running")
 	}
 
-	cmd := exec.Command("bash", "-c", c.env+task.Run)
+	cmd := exec.Command("bash", "-c", c.env+task.Env.Public().AsExport()+task.Run)
 	c.cmd = cmd
 
+	// Pass secrets via environment, so they don't show up in `ps` output.
+	secrets := append(append(EnvList{}, c.secrets...), task.Env.Secrets()...)
+	if len(secrets) > 0 {
+		cmd.Env = os.Environ()
+		for _, v := range secrets {
+			cmd.Env = append(cmd.Env, v.String())
+		}
+	}
+
 	c.stdout, err = cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -0,0 +1,47 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Mask replaces secret values in the output.
+const Mask = "***"
+
+// maskWriter redacts secret values from all data written to the underlying
+// writer. Secrets are expected to be written within a single Write call,
+// which holds for the line-by-line output of prefixer. Multi-line secrets
+// are therefore masked line by line.
+type maskWriter struct {
+	w       io.Writer
+	secrets [][]byte
+}
+
+// NewMaskWriter returns a writer that replaces every occurrence of given
+// secrets with Mask before writing to w.
+func NewMaskWriter(w io.Writer, secrets []string) io.Writer {
+	if len(secrets) == 0 {
+		return w
+	}
+	m := &maskWriter{w: w}
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				m.secrets = append(m.secrets, []byte(line))
+			}
+		}
+	}
+	return m
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	masked := p
+	for _, secret := range m.secrets {
+		masked = bytes.Replace(masked, secret, []byte(Mask), -1)
+	}
+	if _, err := m.w.Write(masked); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,60 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// promptMu serializes prompts of concurrently connecting hosts.
+var promptMu sync.Mutex
+
+// readPassword prompts for a secret on the controlling terminal with echo
+// turned off. It fails if there's no terminal, ie. in CI.
+func readPassword(prompt string) (string, error) {
+	return readLine(prompt, false)
+}
+
+// readLine prompts for a line on the controlling terminal.
+func readLine(prompt string, echo bool) (string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("no terminal to prompt on")
+	}
+	defer tty.Close()
+
+	if !echo {
+		if err := ttyEcho(tty, false); err == nil {
+			defer ttyEcho(tty, true)
+		}
+	}
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if !echo {
+		fmt.Fprintln(tty)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// ttyEcho turns echo of the terminal on or off using stty.
+func ttyEcho(tty *os.File, on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
@@ -0,0 +1,338 @@
+package sup
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// proxy returns the network's proxy URL and proxy command. Proxy defaults
+// to ALL_PROXY env var, unless proxy_command is set.
+func (n *Network) proxy() (string, string) {
+	if n.Proxy != "" || n.ProxyCommand != "" {
+		return n.Proxy, n.ProxyCommand
+	}
+	if proxy := os.Getenv("ALL_PROXY"); proxy != "" {
+		return proxy, ""
+	}
+	return os.Getenv("all_proxy"), ""
+}
+
+// parseProxy parses proxy URL of the form "socks5://[user:pass@]host:port"
+// or "http://[user:pass@]host:port". Scheme defaults to http.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy")
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port of proxy %v", u.Host)
+	}
+	return u, nil
+}
+
+// validateProxy checks the proxy URL and that not both proxy and proxy
+// command are set.
+func validateProxy(proxy, proxyCommand string) error {
+	if proxy != "" && proxyCommand != "" {
+		return errors.New("proxy and proxy_command are mutually exclusive")
+	}
+	if proxy == "" {
+		return nil
+	}
+	_, err := parseProxy(proxy)
+	return err
+}
+
+// dialer returns the dial func of the client's proxy, or ssh.Dial if it
+// has none.
+func (c *SSHClient) dialer() SSHDialFunc {
+	var dial func(addr string) (net.Conn, error)
+	switch {
+	case c.proxyCommand != "":
+		dial = func(addr string) (net.Conn, error) {
+			return dialCommand(c.proxyCommand, addr, c.user)
+		}
+	case c.proxy != "":
+		dial = func(addr string) (net.Conn, error) {
+			u, err := parseProxy(c.proxy)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme == "http" {
+				return dialHTTP(u, addr)
+			}
+			return dialSOCKS5(u, addr)
+		}
+	default:
+		return ssh.Dial
+	}
+
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(sshConn, chans, reqs), nil
+	}
+}
+
+// proxyTimeout limits connecting to the proxy and its handshake.
+const proxyTimeout = 30 * time.Second
+
+// dialSOCKS5 connects to addr through SOCKS5 proxy. Host names are resolved
+// by the proxy.
+func dialSOCKS5(u *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid port")
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, proxyTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to proxy failed")
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if err := socks5Handshake(conn, u.User, host, port); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "socks5 proxy %v", u.Host)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	// Greeting with the supported auth methods.
+	methods := []byte{0x00} // No auth.
+	if user != nil {
+		methods = append(methods, 0x02) // Username/password.
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return errors.New("proxy requires authentication")
+		}
+		password, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(password) > 255 {
+			return errors.New("too long proxy username or password")
+		}
+		auth := append([]byte{0x01, byte(len(name))}, name...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("proxy authentication failed")
+		}
+	default:
+		return errors.New("no acceptable proxy auth method")
+	}
+
+	// Connect request.
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("too long host name")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("connect failed: %v", socks5Errors[head[1]])
+	}
+	// Skip the bound address.
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return errors.New("unexpected proxy reply")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+var socks5Errors = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// dialHTTP connects to addr through HTTP proxy by CONNECT request.
+func dialHTTP(u *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, proxyTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to proxy failed")
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "http proxy %v", u.Host)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "http proxy %v", u.Host)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %v: CONNECT failed: %v", u.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The server may have sent its version already.
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn reads data buffered while reading the proxy's reply first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialCommand runs proxy command with %h, %p and %r replaced by the host,
+// port and user, and connects to its STDIN and STDOUT, like OpenSSH's
+// ProxyCommand.
+func dialCommand(command, addr, user string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	command = strings.NewReplacer("%h", host, "%p", port, "%r", user, "%%", "%").Replace(command)
+
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "starting proxy command failed")
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: addr}, nil
+}
+
+// commandConn is a connection over STDIN and STDOUT of the proxy command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	addr   string
+}
+
+func (c *commandConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+// Close closes STDIN of the command and kills it, if it doesn't exit
+// on its own.
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	exited := make(chan struct{})
+	go func() {
+		c.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		c.cmd.Process.Kill()
+		<-exited
+	}
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr("proxy command") }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr(c.addr) }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// commandAddr is the address of commandConn.
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxy-command" }
+func (a commandAddr) String() string  { return string(a) }
@@ -0,0 +1,182 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SupfileVersions lists all the supported Supfile versions.
+var SupfileVersions = []string{"0.1", "0.2", "0.3", "0.4", "0.5"}
+
+// versionedKeys lists keys not supported before a given Supfile version,
+// as checked by NewSupfile.
+var versionedKeys = []struct {
+	section string // Supfile section, ie. "commands".
+	key     string
+	since   string
+}{
+	{"commands", "run_once", "0.2"},
+	{"commands", "once", "0.3"},
+	{"commands", "local", "0.3"},
+	{"commands", "serial", "0.3"},
+	{"networks", "inventory", "0.3"},
+}
+
+// schema is a JSON Schema (draft-07) node.
+type schema map[string]interface{}
+
+// JSONSchema returns JSON Schema of the Supfile format, generated from
+// the Supfile struct. Editors with YAML language server can use it
+// for autocompletion and validation.
+func JSONSchema() ([]byte, error) {
+	defs := map[string]schema{}
+
+	var versions []interface{}
+	for _, version := range SupfileVersions {
+		versions = append(versions, version)
+		if f, err := strconv.ParseFloat(version, 64); err == nil {
+			versions = append(versions, f) // ie. `version: 0.4`
+		}
+	}
+
+	root := typeSchema(reflect.TypeOf(Supfile{}), defs)
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "Supfile"
+	root["definitions"] = defs
+	root["properties"].(schema)["version"] = schema{"enum": versions}
+
+	// Keys rejected by older Supfile versions.
+	var rules []interface{}
+	for _, version := range SupfileVersions {
+		props := map[string]schema{}
+		for _, k := range versionedKeys {
+			if versionLess(version, k.since) {
+				if props[k.section] == nil {
+					props[k.section] = schema{}
+				}
+				props[k.section][k.key] = false
+			}
+		}
+		if len(props) == 0 {
+			continue
+		}
+
+		then := schema{}
+		for section, keys := range props {
+			then[section] = schema{"additionalProperties": schema{"properties": keys}}
+		}
+		match := []interface{}{version}
+		if f, err := strconv.ParseFloat(version, 64); err == nil {
+			match = append(match, f)
+		}
+		rule := schema{
+			"if":   schema{"properties": schema{"version": schema{"enum": match}}},
+			"then": schema{"properties": then},
+		}
+		// Missing version defaults to the first one.
+		if version == SupfileVersions[0] {
+			rule["if"] = schema{"anyOf": []interface{}{
+				rule["if"],
+				schema{"not": schema{"required": []string{"version"}}},
+			}}
+		}
+		rules = append(rules, rule)
+	}
+	root["allOf"] = rules
+
+	return json.MarshalIndent(root, "", "  ")
+}
+
+// typeSchema returns JSON Schema of a Go type the Supfile is decoded into.
+// Structs are added to defs and referenced.
+func typeSchema(t reflect.Type, defs map[string]schema) schema {
+	switch t {
+	case networksType:
+		return schema{"type": "object", "additionalProperties": typeSchema(reflect.TypeOf(Network{}), defs)}
+	case commandsType:
+		return schema{"type": "object", "additionalProperties": typeSchema(reflect.TypeOf(Command{}), defs)}
+	case targetsType:
+		return schema{"type": "object", "additionalProperties": typeSchema(reflect.TypeOf([]string{}), defs)}
+	case envListType:
+		scalar := schema{"type": []string{"string", "number", "boolean", "null"}}
+		defs["env"] = schema{
+			"type": "object",
+			"additionalProperties": schema{"oneOf": []interface{}{
+				scalar,
+				schema{
+					"type": "object",
+					"properties": schema{
+						"value":    scalar,
+						"secret":   schema{"type": "boolean"},
+						"provider": schema{"type": "string"},
+					},
+					"additionalProperties": false,
+				},
+			}},
+		}
+		return schema{"$ref": "#/definitions/env"}
+	case importType:
+		defs["import"] = schema{"oneOf": []interface{}{
+			schema{"type": "string"},
+			structSchema(t, defs),
+		}}
+		return schema{"$ref": "#/definitions/import"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return schema{"type": []string{"string", "number", "boolean"}}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Slice:
+		return schema{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(Supfile{}) {
+			return structSchema(t, defs)
+		}
+		name := lowerFirst(t.Name())
+		if _, ok := defs[name]; !ok {
+			defs[name] = nil // Recursion guard.
+			defs[name] = structSchema(t, defs)
+		}
+		return schema{"$ref": "#/definitions/" + name}
+	}
+	return schema{}
+}
+
+func structSchema(t reflect.Type, defs map[string]schema) schema {
+	props := schema{}
+	for key, field := range yamlFields(t) {
+		props[key] = typeSchema(field, defs)
+	}
+	return schema{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// versionLess compares "major.minor" Supfile versions.
+func versionLess(a, b string) bool {
+	var aMajor, aMinor, bMajor, bMinor int
+	fmt.Sscanf(a, "%d.%d", &aMajor, &aMinor)
+	fmt.Sscanf(b, "%d.%d", &bMajor, &bMinor)
+	if aMajor != bMajor {
+		return aMajor < bMajor
+	}
+	return aMinor < bMinor
+}
@@ -0,0 +1,84 @@
+package sup
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardSignals are the signals passed on to all active sessions.
+var forwardSignals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// sshSignals maps local signals to the ones of SSH sessions.
+var sshSignals = map[os.Signal]ssh.Signal{
+	os.Interrupt:    ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// killer force-stops the client's session, ie. on a second Ctrl-C.
+type killer interface {
+	Kill() error
+}
+
+// Kill closes the connection, so the session fails right away even
+// if the remote command ignores the signals.
+func (c *SSHClient) Kill() error {
+	if !c.connOpened {
+		return nil
+	}
+	c.lostMu.Lock()
+	c.killed = true
+	c.lostMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *LocalhostClient) Kill() error {
+	if c.cmd == nil || c.cmd.Process == nil {
+		return nil
+	}
+	return c.cmd.Process.Kill()
+}
+
+// windowChanger resizes the client's terminal.
+type windowChanger interface {
+	WindowChange(width, height int) error
+}
+
+// WindowChange resizes the remote pseudo terminal.
+func (c *SSHClient) WindowChange(width, height int) error {
+	if !c.sessOpened || !c.pty {
+		return nil
+	}
+	req := struct {
+		Width, Height             uint32
+		WidthPixels, HeightPixels uint32
+	}{uint32(width), uint32(height), 0, 0}
+	_, err := c.sess.SendRequest("window-change", false, ssh.Marshal(&req))
+	return err
+}
+
+// terminalSize returns size of the local terminal, or 80x40 if none
+// of STDOUT, STDERR and STDIN is a terminal.
+func terminalSize() (width, height int) {
+	for _, f := range []*os.File{os.Stdout, os.Stderr, os.Stdin} {
+		var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+		if errno == 0 && ws.Col > 0 && ws.Row > 0 {
+			return int(ws.Col), int(ws.Row)
+		}
+	}
+	return 80, 40
+}
@@ -1,6 +1,8 @@
 package sup
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,7 +12,9 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -26,9 +30,26 @@ type SSHClient struct {
 	remoteStderr io.Reader
 	connOpened   bool
 	sessOpened   bool
+	pty          bool // Pseudo terminal requested for the session.
 	running      bool
 	env          string //export FOO="bar"; export BAR="baz";
+	secrets      EnvList
 	color        string
+	signers      []ssh.Signer // Tried before the user's keys, ie. certificate_file.
+	creds        *credentials // Auth methods and password, publickey only if nil.
+	tried        []string     // Auth methods tried, see authMethods.
+
+	aliveInterval time.Duration // Keepalive interval, none if zero.
+	aliveCountMax int           // Keepalives without reply to consider the connection lost.
+	lost          bool          // Connection closed by keepAlive.
+	killed        bool          // Connection closed by Kill.
+	lostMu        sync.Mutex
+	closed        chan struct{} // Closed with the connection, see watch.
+
+	agentForwarded bool
+
+	proxy        string // SOCKS5 or HTTP proxy URL, see parseProxy.
+	proxyCommand string // Command to connect through, see dialCommand.
 }
 
 type ErrConnect struct {
@@ -77,20 +98,33 @@ func (c *SSHClient) parseHost(host string) error {
 }
 
 var initAuthMethodOnce sync.Once
-var authMethod ssh.AuthMethod
+
+// authSigners are the user's keys and certificates, tried in order.
+var authSigners []ssh.Signer
+
+// certExpiryWarning is how long before expiry certificates are warned about.
+const certExpiryWarning = 15 * time.Minute
+
+// keyring is the built-in in-memory SSH agent, used instead of the missing
+// ssh-agent. It holds the user's keys, including the decrypted ones.
+var keyring agent.Agent
 
 // initAuthMethod initiates SSH authentication method.
 func initAuthMethod() {
 	var signers []ssh.Signer
 
 	// If there's a running SSH Agent, try to use its Private keys.
+	// Otherwise, fall back to the built-in one.
 	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 	if err == nil {
 		agent := agent.NewClient(sock)
 		signers, _ = agent.Signers()
+	} else {
+		keyring = agent.NewKeyring()
 	}
 
 	// Try to read user's SSH private keys form the standard paths.
+	var passphrases []string
 	files, _ := filepath.Glob(os.Getenv("HOME") + "/.ssh/id_*")
 	for _, file := range files {
 		if strings.HasSuffix(file, ".pub") {
@@ -100,23 +134,211 @@ func initAuthMethod() {
 		if err != nil {
 			continue
 		}
-		signer, err := ssh.ParsePrivateKey(data)
+
+		if keyring == nil {
+			// Encrypted keys are expected to be loaded in the agent.
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				continue
+			}
+			signers = append(signers, signer)
+			continue
+		}
+
+		key, err := parsePrivateKey(file, data, &passphrases)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping key %v: %v\n", file, err)
+			continue
+		}
+		if key == nil {
+			continue
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: file}); err != nil {
+			continue
+		}
+	}
+
+	if keyring != nil {
+		signers, _ = keyring.Signers()
+	}
+
+	// Pair the keys with their certificates, ie. id_rsa-cert.pub.
+	// Certificates are tried first.
+	var certs []ssh.Signer
+	files, _ = filepath.Glob(os.Getenv("HOME") + "/.ssh/id_*-cert.pub")
+	for _, file := range files {
+		signer, err := certSigner(file, signers)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping certificate %v: %v\n", file, err)
 			continue
 		}
-		signers = append(signers, signer)
+		if signer != nil {
+			certs = append(certs, signer)
+		}
+	}
+	authSigners = append(certs, signers...)
+}
+
+// loadCertificate returns signer of the SSH user certificate file.
+// The private key is looked up among the user's keys, falling back
+// to the certificate file name without "-cert.pub" suffix. It returns
+// nil signer if the certificate is loaded in the SSH agent already.
+func loadCertificate(file string) (ssh.Signer, error) {
+	initAuthMethodOnce.Do(initAuthMethod)
+
+	file = expandHome(file)
+	signers := authSigners
+	keyFile := strings.TrimSuffix(file, "-cert.pub")
+	if data, err := ioutil.ReadFile(keyFile); err == nil && keyFile != file {
+		var passphrases []string
+		key, err := parsePrivateKey(keyFile, data, &passphrases)
+		if _, ok := err.(unsupportedKeyError); ok {
+			// The key may be in the agent.
+			fmt.Fprintf(os.Stderr, "Warning: skipping key %v: %v\n", keyFile, err)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "reading key %v failed", keyFile)
+		}
+		if key != nil {
+			signer, err := ssh.NewSignerFromKey(key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading key %v failed", keyFile)
+			}
+			signers = append(signers, signer)
+		}
+	}
+
+	signer, err := certSigner(file, signers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "certificate %v", file)
+	}
+	return signer, nil
+}
+
+// certSigner pairs the certificate file with its private key of the given
+// signers. It warns if the certificate is about to expire and fails if it
+// has expired. It returns nil signer if the certificate is among signers
+// already, ie. loaded in the SSH agent.
+func certSigner(file string, signers []ssh.Signer) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not an SSH certificate")
+	}
+
+	now := time.Now()
+	if cert.ValidAfter != 0 && now.Before(time.Unix(int64(cert.ValidAfter), 0)) {
+		return nil, errors.Errorf("not valid until %v", time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		expiry := time.Unix(int64(cert.ValidBefore), 0)
+		if now.After(expiry) {
+			return nil, errors.Errorf("expired at %v", expiry.Format(time.RFC3339))
+		}
+		if left := expiry.Sub(now); left < certExpiryWarning {
+			fmt.Fprintf(os.Stderr, "Warning: certificate %v expires in %v\n", file, left/time.Second*time.Second)
+		}
+	}
+
+	var key ssh.Signer
+	for _, signer := range signers {
+		switch string(signer.PublicKey().Marshal()) {
+		case string(cert.Marshal()):
+			return nil, nil
+		case string(cert.Key.Marshal()):
+			if key == nil {
+				key = signer
+			}
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no private key of the certificate")
+	}
+	return ssh.NewCertSigner(cert, key)
+}
 
+// expandHome expands "~/" prefix of the path to $HOME.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
 	}
-	authMethod = ssh.PublicKeys(signers...)
+	return path
+}
+
+// unsupportedKeyError is returned for keys in the OpenSSH format (default
+// since OpenSSH 7.8), which can't be read unless unencrypted ed25519 ones.
+type unsupportedKeyError string
+
+func (file unsupportedKeyError) Error() string {
+	return fmt.Sprintf("encrypted or non-ed25519 key in OpenSSH format is not supported, "+
+		"load it into ssh-agent or convert it to PEM by `ssh-keygen -p -m PEM -f %v`", string(file))
+}
+
+// parsePrivateKey parses the private key file. Encrypted keys are decrypted
+// by one of the passphrases entered so far, or the user is prompted for
+// a new one. It returns nil key for files that are not private keys.
+func parsePrivateKey(file string, data []byte, passphrases *[]string) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil
+	}
+	if !x509.IsEncryptedPEMBlock(block) {
+		key, err := ssh.ParseRawPrivateKey(data)
+		if err != nil {
+			if block.Type == "OPENSSH PRIVATE KEY" {
+				return nil, unsupportedKeyError(file)
+			}
+			return nil, nil
+		}
+		return key, nil
+	}
+
+	decrypt := func(passphrase string) (interface{}, error) {
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParseRawPrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}))
+	}
+	for _, passphrase := range *passphrases {
+		if key, err := decrypt(passphrase); err == nil {
+			return key, nil
+		}
+	}
+	for i := 0; i < 3; i++ {
+		passphrase, err := readPassword(fmt.Sprintf("Enter passphrase for key '%v': ", file))
+		if err != nil {
+			return nil, err
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("no passphrase given")
+		}
+		key, err := decrypt(passphrase)
+		if err == x509.IncorrectPasswordError {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*passphrases = append(*passphrases, passphrase)
+		return key, nil
+	}
+	return nil, x509.IncorrectPasswordError
 }
 
 // SSHDialFunc can dial an ssh server and return a client
 type SSHDialFunc func(net, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
 
-// Connect creates SSH connection to a specified host.
-// It expects the host of the form "[ssh://]host[:port]".
+// Connect creates SSH connection to a specified host, through the proxy
+// if set. It expects the host of the form "[ssh://]host[:port]".
 func (c *SSHClient) Connect(host string) error {
-	return c.ConnectWith(host, ssh.Dial)
+	return c.ConnectWith(host, c.dialer())
 }
 
 // ConnectWith creates a SSH connection to a specified host. It will use dialer to establish the
@@ -136,17 +358,20 @@ func (c *SSHClient) ConnectWith(host string, dialer SSHDialFunc) error {
 
 	config := &ssh.ClientConfig{
 		User: c.user,
-		Auth: []ssh.AuthMethod{
-			authMethod,
-		},
+		Auth: c.authMethods(),
 	}
 
 	c.conn, err = dialer("tcp", c.host, config)
 	if err != nil {
+		if len(c.tried) > 0 || strings.Contains(err.Error(), "unable to authenticate") {
+			return ErrConnect{c.user, c.host, c.authError()}
+		}
 		return ErrConnect{c.user, c.host, err.Error()}
 	}
 	c.connOpened = true
 
+	c.watch()
+
 	return nil
 }
 
@@ -159,11 +384,41 @@ func (c *SSHClient) Run(task *Task) error {
 		return fmt.Errorf("Session already connected")
 	}
 
+	// Secrets are sourced from a temporary file, so they never show up
+	// in the remote command line (and thus `ps` output). The file is
+	// readable by the login user only, so it's sourced before sudo.
+	env := c.env + task.Env.Public().AsExport()
+	secrets := append(append(EnvList{}, c.secrets...), task.Env.Secrets()...)
+	sourceSecrets := ""
+	if len(secrets) > 0 {
+		file, err := c.uploadSecrets(secrets)
+		if err != nil {
+			return ErrTask{task, fmt.Sprintf("uploading secrets failed: %v", err)}
+		}
+		sourceSecrets = `. "` + file + `"; rm -f "` + file + `"; `
+
+		// The command removes the file, unless it fails to start.
+		defer func() {
+			if !c.sessOpened {
+				c.removeFile(file)
+			}
+		}()
+	}
+
 	sess, err := c.conn.NewSession()
 	if err != nil {
 		return err
 	}
 
+	if task.ForwardAgent {
+		if err := c.forwardAgent(); err != nil {
+			return ErrTask{task, fmt.Sprintf("agent forwarding failed: %v", err)}
+		}
+		if err := agent.RequestAgentForwarding(sess); err != nil {
+			return ErrTask{task, fmt.Sprintf("agent forwarding failed: %v", err)}
+		}
+	}
+
 	c.remoteStdin, err = sess.StdinPipe()
 	if err != nil {
 		return err
@@ -179,21 +434,46 @@ func (c *SSHClient) Run(task *Task) error {
 		return err
 	}
 
-	if task.TTY {
+	if task.Become {
+		// Sudo prompts for password on the terminal.
+		c.remoteStdout = &sudoPrompter{
+			r: c.remoteStdout,
+			w: c.remoteStdin,
+			password: func() (string, error) {
+				if c.creds == nil {
+					return readPassword("Sudo password: ")
+				}
+				return c.creds.getSudoPassword()
+			},
+		}
+	}
+
+	if task.TTY || task.Become {
 		// Set up terminal modes
 		modes := ssh.TerminalModes{
 			ssh.ECHO:          0,     // disable echoing
 			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
 			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
 		}
-		// Request pseudo terminal
-		if err := sess.RequestPty("xterm", 80, 40, modes); err != nil {
+		// Request pseudo terminal of the local terminal size
+		width, height := terminalSize()
+		if err := sess.RequestPty("xterm", height, width, modes); err != nil {
 			return ErrTask{task, fmt.Sprintf("request for pseudo terminal failed: %s", err)}
 		}
 	}
+	c.pty = task.TTY || task.Become
 
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	command := env + task.Run
+	if task.Become {
+		var keys []string
+		for _, v := range secrets {
+			keys = append(keys, v.Key)
+		}
+		command = sudoCommand(task.BecomeUser, command, keys)
+	}
+	command = sourceSecrets + command
+	if err := sess.Start(command); err != nil {
 		return ErrTask{task, err.Error()}
 	}
 
@@ -203,6 +483,65 @@ func (c *SSHClient) Run(task *Task) error {
 	return nil
 }
 
+// forwardAgent routes the remote host's agent requests to the local
+// SSH agent, or the built-in keyring if there's none. It's set up once
+// per connection, sessions have to request the forwarding separately.
+// Hosts behind bastion are connected end-to-end, so the forwarding works
+// through the bastion as well.
+func (c *SSHClient) forwardAgent() error {
+	if c.agentForwarded {
+		return nil
+	}
+	if keyring != nil {
+		if err := agent.ForwardToAgent(c.conn, keyring); err != nil {
+			return err
+		}
+		c.agentForwarded = true
+		return nil
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("no SSH agent, SSH_AUTH_SOCK is not set")
+	}
+	if err := agent.ForwardToRemote(c.conn, sock); err != nil {
+		return err
+	}
+	c.agentForwarded = true
+	return nil
+}
+
+// uploadSecrets writes secret env vars as export statements into
+// a temporary file readable by the remote user only. The secrets are
+// streamed over the session's STDIN. It returns the remote file path.
+func (c *SSHClient) uploadSecrets(secrets EnvList) (string, error) {
+	sess, err := c.conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+
+	sess.Stdin = strings.NewReader(secrets.AsExport())
+	out, err := sess.Output(`umask 077 && f=$(mktemp "${TMPDIR:-/tmp}/sup.XXXXXXXX") && cat > "$f" && echo "$f"`)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// removeFile removes the remote file, ie. of secrets not sourced.
+func (c *SSHClient) removeFile(file string) {
+	sess, err := c.conn.NewSession()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: removing %v failed: %v\n", file, err)
+		return
+	}
+	defer sess.Close()
+	if err := sess.Run(`rm -f "` + file + `"`); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: removing %v failed: %v\n", file, err)
+	}
+}
+
 // Wait waits until the remote command finishes and exits.
 // It closes the SSH session.
 func (c *SSHClient) Wait() error {
@@ -215,6 +554,11 @@ func (c *SSHClient) Wait() error {
 	c.running = false
 	c.sessOpened = false
 
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		if lostErr := c.lostError(); lostErr != nil {
+			return lostErr
+		}
+	}
 	return err
 }
 
@@ -289,6 +633,10 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		c.remoteStdin.Write([]byte("\x03"))
 		return c.sess.Signal(ssh.SIGINT)
 	default:
-		return fmt.Errorf("%v not supported", sig)
+		sshSig, ok := sshSignals[sig]
+		if !ok {
+			return fmt.Errorf("%v not supported", sig)
+		}
+		return c.sess.Signal(sshSig)
 	}
 }
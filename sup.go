@@ -3,10 +3,14 @@ package sup
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
@@ -16,9 +20,10 @@ import (
 const VERSION = "0.5"
 
 type Stackup struct {
-	conf   *Supfile
-	debug  bool
-	prefix bool
+	conf      *Supfile
+	debug     bool
+	prefix    bool
+	retryFile string
 }
 
 func New(conf *Supfile) (*Stackup, error) {
@@ -28,26 +33,164 @@ func New(conf *Supfile) (*Stackup, error) {
 }
 
 // Run runs set of commands on multiple hosts defined by network sequentially.
-// TODO: This megamoth method needs a big refactor and should be split
-//       to multiple smaller methods.
 func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
 	if len(commands) == 0 {
 		return errors.New("no commands to be run")
 	}
 
-	env := envVars.AsExport()
+	session, err := sup.Connect(network, envVars)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// Run command or run multiple commands defined by target sequentially.
+	stderr := NewMaskWriter(os.Stderr, envVars.SecretValues())
+	for _, cmd := range commands {
+		results, err := session.Run(cmd, nil)
+		if err != nil {
+			return err
+		}
+
+		// Exit on the first failure.
+		exitStatus := 0
+		var failed []string
+		localFailed := false
+		for _, result := range results {
+			if result.Err == nil {
+				continue
+			}
+			if session.isLocal(result.client) {
+				localFailed = true
+			} else {
+				failed = append(failed, result.Host)
+			}
+			fmt.Fprintf(stderr, "%s%v\n", session.prefix(result.client), result.Err)
+			if exitStatus != 0 {
+				continue
+			}
+			exitStatus = 1
+			if status := result.ExitStatus; status > 0 && status != 15 {
+				exitStatus = status
+			}
+		}
+		if exitStatus != 0 {
+			// Local command runs for the whole network, rerun all of it.
+			if localFailed {
+				failed = session.network.Hosts
+			}
+			sup.writeRetryFile(failed)
+			os.Exit(exitStatus)
+		}
+	}
+
+	// Standalone forward command keeps the forwards open until interrupted.
+	if len(commands[len(commands)-1].Forward) > 0 {
+		fmt.Fprintln(os.Stderr, "Forwarding, press Ctrl-C to stop.")
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		<-sig
+		signal.Stop(sig)
+	}
+
+	return nil
+}
+
+// Session holds connections to network hosts, so multiple commands
+// can be run without reconnecting.
+type Session struct {
+	sup     *Stackup
+	network *Network
+	vars    EnvList
+	bastion *SSHClient
+	clients []Client // In the same order as network hosts.
+	maxLen  int
+
+	listeners []net.Listener // Port forwards open until Close.
+
+	keepConnections bool // See KeepConnections.
+}
+
+// HostResult is the outcome of a command on a single host.
+type HostResult struct {
+	Host       string
+	ExitStatus int // -1 if the command didn't finish.
+	Err        error
+
+	client Client
+}
+
+// Connect connects to all the network hosts.
+func (sup *Stackup) Connect(network *Network, envVars EnvList) (*Session, error) {
+	// No-op if resolved already, ie. by the sup command.
+	if err := network.ResolveInventory(false); err != nil {
+		return nil, err
+	}
+	if len(network.Hosts) == 0 {
+		return nil, errors.Errorf("network %v has no hosts", network.Name)
+	}
+
+	env := envVars.Public().AsExport()
+	secrets := envVars.Secrets()
+
+	s := &Session{
+		sup:     sup,
+		network: network,
+		vars:    envVars,
+	}
+
+	var signers []ssh.Signer
+	if network.CertificateFile != "" {
+		signer, err := loadCertificate(network.CertificateFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "network %v", network.Name)
+		}
+		if signer != nil {
+			signers = append(signers, signer)
+		}
+	}
+
+	creds := newCredentials(network, envVars)
+
+	ttl, err := network.controlPersist()
+	if err != nil {
+		return nil, errors.Wrapf(err, "network %v", network.Name)
+	}
+	aliveInterval, aliveCountMax, err := network.serverAlive()
+	if err != nil {
+		return nil, errors.Wrapf(err, "network %v", network.Name)
+	}
+	proxy, proxyCommand := network.proxy()
 
 	// Create clients for every host (either SSH or Localhost).
-	var bastion *SSHClient
-	if network.Bastion != "" {
-		bastion = &SSHClient{}
-		if err := bastion.Connect(network.Bastion); err != nil {
-			return errors.Wrap(err, "connecting to bastion failed")
+	// With control_persist, bastion is needed only if a control master
+	// fails to start.
+	var bastionOnce sync.Once
+	var bastionErr error
+	connectBastion := func() error {
+		bastionOnce.Do(func() {
+			bastion := &SSHClient{
+				signers:       signers,
+				creds:         creds,
+				aliveInterval: aliveInterval,
+				aliveCountMax: aliveCountMax,
+				proxy:         proxy,
+				proxyCommand:  proxyCommand,
+			}
+			if bastionErr = bastion.Connect(network.Bastion); bastionErr == nil {
+				s.bastion = bastion
+			}
+		})
+		return bastionErr
+	}
+	if network.Bastion != "" && ttl == 0 {
+		if err := connectBastion(); err != nil {
+			return nil, errors.Wrap(err, "connecting to bastion failed")
 		}
 	}
 
 	var wg sync.WaitGroup
-	clientCh := make(chan Client, len(network.Hosts))
+	s.clients = make([]Client, len(network.Hosts))
 	errCh := make(chan error, len(network.Hosts))
 
 	for i, host := range network.Hosts {
@@ -58,25 +201,47 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 			// Localhost client.
 			if host == "localhost" {
 				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
+					env:     env + EnvVar{Key: "SUP_HOST", Value: host}.AsExport() + network.HostVars[host].AsExport(),
+					secrets: secrets,
 				}
 				if err := local.Connect(host); err != nil {
 					errCh <- errors.Wrap(err, "connecting to localhost failed")
 					return
 				}
-				clientCh <- local
+				s.clients[i] = local
 				return
 			}
 
 			// SSH client.
 			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
-				user:  network.User,
-				color: Colors[i%len(Colors)],
+				env:     env + EnvVar{Key: "SUP_HOST", Value: host}.AsExport() + network.HostVars[host].AsExport(),
+				secrets: secrets,
+				user:    network.User,
+				color:   Colors[i%len(Colors)],
+				signers: signers,
+				creds:   creds,
+
+				aliveInterval: aliveInterval,
+				aliveCountMax: aliveCountMax,
+				proxy:         proxy,
+				proxyCommand:  proxyCommand,
+			}
+
+			if ttl > 0 {
+				err := remote.ConnectControl(host, network.Bastion, ttl)
+				if err == nil {
+					s.clients[i] = remote
+					return
+				}
+				fmt.Fprintf(os.Stderr, "Warning: %v, connecting directly\n", err)
 			}
 
-			if bastion != nil {
-				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
+			if network.Bastion != "" {
+				if err := connectBastion(); err != nil {
+					errCh <- errors.Wrap(err, "connecting to bastion failed")
+					return
+				}
+				if err := remote.ConnectWith(host, s.bastion.DialThrough); err != nil {
 					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
 					return
 				}
@@ -86,158 +251,318 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 					return
 				}
 			}
-			clientCh <- remote
+			s.clients[i] = remote
 		}(i, host)
 	}
 	wg.Wait()
-	close(clientCh)
 	close(errCh)
 
-	maxLen := 0
-	var clients []Client
-	for client := range clientCh {
-		if remote, ok := client.(*SSHClient); ok {
-			defer remote.Close()
+	for err := range errCh {
+		var failed []string
+		for i, client := range s.clients {
+			if client == nil {
+				failed = append(failed, network.Hosts[i])
+			}
 		}
+		sup.writeRetryFile(failed)
+		s.Close()
+		return nil, errors.Wrap(err, "connecting to clients failed")
+	}
+
+	for _, client := range s.clients {
 		_, prefixLen := client.Prefix()
-		if prefixLen > maxLen {
-			maxLen = prefixLen
+		if prefixLen > s.maxLen {
+			s.maxLen = prefixLen
 		}
-		clients = append(clients, client)
 	}
-	for err := range errCh {
-		return errors.Wrap(err, "connecting to clients failed")
+
+	return s, nil
+}
+
+// KeepConnections keeps the connections open on second Ctrl-C, which
+// passes the interrupt on again instead, ie. in the interactive shell,
+// where the session is used for later commands.
+func (s *Session) KeepConnections(value bool) {
+	s.keepConnections = value
+}
+
+// Hosts returns all the session hosts.
+func (s *Session) Hosts() []string {
+	return s.network.Hosts
+}
+
+// Close closes all the connections.
+func (s *Session) Close() error {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, client := range s.clients {
+		if remote, ok := client.(*SSHClient); ok {
+			remote.Close()
+		}
+	}
+	if s.bastion != nil {
+		s.bastion.Close()
 	}
+	return nil
+}
 
-	// Run command or run multiple commands defined by target sequentially.
-	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
+// Run runs the command on the given hosts, indexes of Hosts(), or on all
+// the hosts if hosts is nil. It stops after the first task that fails on any
+// host and returns results of the hosts the command ran on.
+func (s *Session) Run(cmd *Command, hosts []int) ([]HostResult, error) {
+	network := *s.network
+	clients := s.clients
+	if hosts != nil {
+		var selected []string
+		clients = nil
+		for _, i := range hosts {
+			if i < 0 || i >= len(s.clients) {
+				return nil, errors.Errorf("no host number %v", i)
+			}
+			selected = append(selected, s.network.Hosts[i])
+			clients = append(clients, s.clients[i])
+		}
+		network.KeepHosts(selected)
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("no hosts to run the command on")
+	}
+
+	if len(cmd.Forward) > 0 {
+		return s.forward(cmd, clients)
+	}
+
+	// Translate command into task(s).
+	tasks, err := s.sup.createTasks(cmd, &network, clients, s.vars)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating task failed")
+	}
+
+	// Run tasks sequentially.
+	var results []HostResult
+	for _, task := range tasks {
+		errs, err := s.runTask(task)
 		if err != nil {
-			return errors.Wrap(err, "creating task failed")
+			return results, err
 		}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+		failed := false
+		for i, c := range task.Clients {
+			result := HostResult{
+				Host:   s.host(c),
+				Err:    errs[i],
+				client: c,
+			}
+			result.ExitStatus = exitStatus(errs[i])
+			if errs[i] != nil {
+				failed = true
+			}
+			results = append(results, result)
+		}
+		if failed {
+			break
+		}
+	}
 
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
-				}
+	return results, nil
+}
 
-				err := c.Run(task)
-				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
-				}
+// runTask runs the task on its clients and returns their errors,
+// in the same order as task.Clients.
+func (s *Session) runTask(task *Task) ([]error, error) {
+	var writers []io.Writer
+	var wg sync.WaitGroup
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
+	// Redact secret values from all the output.
+	secretValues := append(s.vars.SecretValues(), task.Env.SecretValues()...)
+	stdout := NewMaskWriter(os.Stdout, secretValues)
+	stderr := NewMaskWriter(os.Stderr, secretValues)
+
+	// Run tasks on the provided clients.
+	for _, c := range task.Clients {
+		prefix := s.prefix(c)
+
+		err := c.Run(task)
+		if err != nil {
+			return nil, errors.Wrap(err, prefix+"task failed")
+		}
 
-				writers = append(writers, c.Stdin())
+		// Copy over tasks's STDOUT.
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			_, err := io.Copy(stdout, prefixer.New(c.Stdout(), prefix))
+			if err != nil && err != io.EOF {
+				// TODO: io.Copy() should not return io.EOF at all.
+				// Upstream bug? Or prefixer.WriteTo() bug?
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
+			}
+		}(c)
+
+		// Copy over tasks's STDERR.
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			_, err := io.Copy(stderr, prefixer.New(c.Stderr(), prefix))
+			if err != nil && err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
+			}
+		}(c)
+
+		writers = append(writers, c.Stdin())
+	}
+
+	// Copy over task's STDIN.
+	if task.Input != nil {
+		go func() {
+			writer := io.MultiWriter(writers...)
+			_, err := io.Copy(writer, task.Input)
+			if err != nil && err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
 			}
+			// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+			for _, c := range task.Clients {
+				c.WriteClose()
+			}
+		}()
+	}
+
+	// Copy over per-client STDIN, ie. uploads rendered per host.
+	for _, c := range task.Clients {
+		input, ok := task.Inputs[c]
+		if !ok {
+			continue
+		}
+		go func(c Client, input io.Reader) {
+			_, err := io.Copy(c.Stdin(), input)
+			if err != nil && err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
+			}
+			c.WriteClose()
+		}(c, input)
+	}
 
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
+	// Catch OS signals and pass them to all active clients. Second Ctrl-C
+	// kills the sessions, even if the remote commands ignore the signal,
+	// unless the connections are to be kept.
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, forwardSignals...)
+	winch := make(chan os.Signal, 1)
+	if task.Input != nil {
+		signal.Notify(winch, syscall.SIGWINCH)
+	}
+	go func() {
+		interrupted := false
+		for {
+			select {
+			case sig, ok := <-trap:
+				if !ok {
+					return
+				}
+				if sig == os.Interrupt && interrupted && !s.keepConnections {
+					fmt.Fprintln(os.Stderr, "Interrupted again, closing connections.")
+					for _, c := range task.Clients {
+						if k, ok := c.(killer); ok {
+							k.Kill()
+						}
 					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
+					continue
+				}
+				if sig == os.Interrupt {
+					interrupted = true
+				}
+				for _, c := range task.Clients {
+					err := c.Signal(sig)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
 					}
-				}()
-			}
-
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
-			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
-						}
+				}
+			case <-winch:
+				width, height := terminalSize()
+				for _, c := range task.Clients {
+					if w, ok := c.(windowChanger); ok {
+						w.WindowChange(width, height)
 					}
 				}
-			}()
+			}
+		}
+	}()
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+	// Wait for all I/O operations first.
+	wg.Wait()
 
-			// Make sure each client finishes the task, return on failure.
-			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
+	// Make sure each client finishes the task.
+	errs := make([]error, len(task.Clients))
+	for i, c := range task.Clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			errs[i] = c.Wait()
+		}(i, c)
+	}
 
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
-			}
+	// Wait for all commands to finish.
+	wg.Wait()
 
-			// Wait for all commands to finish.
-			wg.Wait()
+	// Stop catching signals for the currently active clients.
+	signal.Stop(trap)
+	signal.Stop(winch)
+	close(trap)
+
+	return errs, nil
+}
 
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+// prefix returns the client's output prefix, padded to the longest one.
+func (s *Session) prefix(c Client) string {
+	if !s.sup.prefix {
+		return ""
+	}
+	prefix, prefixLen := c.Prefix()
+	if len(prefix) < s.maxLen { // Left padding.
+		prefix = strings.Repeat(" ", s.maxLen-prefixLen) + prefix
+	}
+	return prefix
+}
+
+// host returns the network host of the client.
+func (s *Session) host(c Client) string {
+	for i, client := range s.clients {
+		if client == c {
+			return s.network.Hosts[i]
 		}
 	}
+	if _, ok := c.(*LocalhostClient); ok {
+		return "localhost" // Local command.
+	}
+	return ""
+}
 
-	return nil
+// isLocal reports whether the client runs a local command, rather than
+// being a client of a network host.
+func (s *Session) isLocal(c Client) bool {
+	for _, client := range s.clients {
+		if client == c {
+			return false
+		}
+	}
+	return true
+}
+
+// exitStatus returns exit status of a finished command, 0 on success
+// and -1 if the command didn't finish.
+func exitStatus(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return e.ExitStatus()
+	case *exec.ExitError:
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
 }
 
 func (sup *Stackup) Debug(value bool) {
@@ -247,3 +572,21 @@ func (sup *Stackup) Debug(value bool) {
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// RetryFile sets path of the file to list failed hosts in, one per line.
+// It can be passed back as `--limit @path` to rerun only the failed hosts.
+func (sup *Stackup) RetryFile(path string) {
+	sup.retryFile = path
+}
+
+func (sup *Stackup) writeRetryFile(hosts []string) {
+	if sup.retryFile == "" || len(hosts) == 0 {
+		return
+	}
+	data := strings.Join(hosts, "\n") + "\n"
+	if err := ioutil.WriteFile(sup.retryFile, []byte(data), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", errors.Wrap(err, "writing retry file failed"))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Failed hosts written to %v, rerun them with --limit @%v\n", sup.retryFile, sup.retryFile)
+}
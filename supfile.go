@@ -3,10 +3,13 @@ package sup
 import (
 	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -19,15 +22,73 @@ type Supfile struct {
 	Commands Commands `yaml:"commands"`
 	Targets  Targets  `yaml:"targets"`
 	Env      EnvList  `yaml:"env"`
-	Version  string   `yaml:"version"`
+	EnvFile  string   `yaml:"env_file"`
+	Imports  []Import `yaml:"imports"`
+
+	// Default proxy and proxy command of networks, see Network.
+	Proxy        string `yaml:"proxy"`
+	ProxyCommand string `yaml:"proxy_command"`
+
+	Version string `yaml:"version"`
+
+	sources map[string]keySource // Entries defined in imported Supfiles.
 }
 
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env       EnvList  `yaml:"env"`
-	Inventory string   `yaml:"inventory"`
-	Hosts     []string `yaml:"hosts"`
-	Bastion   string   `yaml:"bastion"` // Jump host for the environment
+	Env          EnvList  `yaml:"env"`
+	EnvFile      string   `yaml:"env_file"`
+	Inventory    string   `yaml:"inventory"`
+	InventoryTTL string   `yaml:"inventory_ttl"` // Cache inventory output, ie. "10m".
+	Hosts        []string `yaml:"hosts"`
+	Bastion      string   `yaml:"bastion"` // Jump host for the environment
+
+	// Ansible-style INI, YAML or JSON inventory file and its group
+	// of hosts, which defaults to the network name.
+	InventoryFile  string `yaml:"inventory_file"`
+	InventoryGroup string `yaml:"inventory_group"`
+
+	ForwardAgent bool `yaml:"forward_agent"` // Forward local SSH agent to all commands.
+
+	// SSH user certificate, ie. issued by CA. Its private key is either
+	// one of the user's keys, or the file without "-cert.pub" suffix.
+	CertificateFile string `yaml:"certificate_file"`
+
+	// SSH authentication methods tried in order, ie. publickey, password
+	// or keyboard-interactive. Password may reference env vars, it's
+	// prompted for once if not set.
+	Auth     []string `yaml:"auth"`
+	Password string   `yaml:"password"`
+
+	// Sudo password of become commands, prompted for once if not set.
+	BecomePassword string `yaml:"become_password"`
+
+	// Keep the connections open in background for later sup runs,
+	// until they're idle for the duration, ie. "10m".
+	ControlPersist string `yaml:"control_persist"`
+
+	// Send keepalives every interval, ie. "30s", and consider the connection
+	// lost after count_max (3 by default) of them get no reply.
+	ServerAliveInterval string `yaml:"server_alive_interval"`
+	ServerAliveCountMax int    `yaml:"server_alive_count_max"`
+
+	// Connect to the hosts, or bastion if set, through SOCKS5 or HTTP
+	// CONNECT proxy, ie. "socks5://proxy:1080", ALL_PROXY env var by default.
+	// Or through STDIN and STDOUT of the proxy command, like OpenSSH's
+	// ProxyCommand, with %h, %p and %r replaced by the host, port and user.
+	Proxy        string `yaml:"proxy"`
+	ProxyCommand string `yaml:"proxy_command"`
+
+	// Tags of the hosts, ie. roles or regions. Keyed by host.
+	HostTags map[string][]string `yaml:"host_tags"`
+
+	// Env vars of the hosts, ie. from inventory file. Keyed by host.
+	HostVars map[string]EnvList `yaml:"-"`
+
+	Name string `yaml:"-"` // Network name.
+
+	inventoryResolved bool     // See ResolveInventory.
+	allHosts          []string // Hosts before KeepHosts.
 
 	// Should these live on Hosts too? We'd have to change []string to struct, even in Supfile.
 	User         string // `yaml:"user"`
@@ -62,20 +123,29 @@ func (n *Networks) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 func (n *Networks) Get(name string) (Network, bool) {
 	net, ok := n.nets[name]
+	net.Name = name
 	return net, ok
 }
 
 // Command represents command(s) to be run remotely.
 type Command struct {
-	Name   string   `yaml:"-"`      // Command name.
-	Desc   string   `yaml:"desc"`   // Command description.
-	Local  string   `yaml:"local"`  // Command(s) to be run locally.
-	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
-	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
-	Upload []Upload `yaml:"upload"` // See Upload struct.
-	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
-	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
-	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	Name    string    `yaml:"-"`        // Command name.
+	Desc    string    `yaml:"desc"`     // Command description.
+	Local   string    `yaml:"local"`    // Command(s) to be run locally.
+	Run     string    `yaml:"run"`      // Command(s) to be run remotelly.
+	Script  string    `yaml:"script"`   // Load command(s) from script and run it remotelly.
+	Upload  []Upload  `yaml:"upload"`   // See Upload struct.
+	Forward []Forward `yaml:"forward"`  // Port forwards open during the run, see Forward struct.
+	Stdin   bool      `yaml:"stdin"`    // Attach localhost STDOUT to remote commands' STDIN?
+	Once    bool      `yaml:"once"`     // The command should be run "once" (on one host only).
+	Serial  int       `yaml:"serial"`   // Max number of clients processing a task in parallel.
+	EnvFile string    `yaml:"env_file"` // Load extra env vars from dotenv file.
+
+	ForwardAgent bool `yaml:"forward_agent"` // Forward local SSH agent, ie. for `git clone`.
+
+	// Run the remote command(s) by sudo as become_user, or root.
+	Become     bool   `yaml:"become"`
+	BecomeUser string `yaml:"become_user"`
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
@@ -146,15 +216,20 @@ func (t *Targets) Get(name string) ([]string, bool) {
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
-	Src string `yaml:"src"`
-	Dst string `yaml:"dst"`
-	Exc string `yaml:"exclude"`
+	Src      string `yaml:"src"`
+	Dst      string `yaml:"dst"`
+	Exc      string `yaml:"exclude"`
+	Template bool   `yaml:"template"` // Render files with text/template per host.
 }
 
 // EnvVar represents an environment variable
 type EnvVar struct {
-	Key   string
-	Value string
+	Key      string
+	Value    string
+	Secret   bool   // Mask the value in output, never pass it on the command line.
+	Provider string // Local command that prints the value, ie. a secret provider.
+
+	resolved bool // The value is final, see ResolveValues.
 }
 
 func (e EnvVar) String() string {
@@ -163,7 +238,7 @@ func (e EnvVar) String() string {
 
 // AsExport returns the environment variable as a bash export statement
 func (e EnvVar) AsExport() string {
-	return `export ` + e.Key + `="` + e.Value + `";`
+	return `export ` + e.Key + `=` + shellQuote(e.Value) + `;`
 }
 
 // EnvList is a list of environment variables that maps to a YAML map,
@@ -181,17 +256,47 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*e = make(EnvList, 0, len(items))
 
 	for _, v := range items {
-		e.Set(fmt.Sprintf("%v", v.Key), fmt.Sprintf("%v", v.Value))
+		key := fmt.Sprintf("%v", v.Key)
+
+		// Extended form, ie. `KEY: {value: VALUE, secret: true}`.
+		if attrs, ok := v.Value.([]yaml.MapItem); ok {
+			env := EnvVar{Key: key}
+			for _, attr := range attrs {
+				switch attr.Key {
+				case "value":
+					env.Value = fmt.Sprintf("%v", attr.Value)
+				case "secret":
+					secret, ok := attr.Value.(bool)
+					if !ok {
+						return fmt.Errorf("env %v: secret must be true or false", key)
+					}
+					env.Secret = secret
+				case "provider":
+					env.Provider = fmt.Sprintf("%v", attr.Value)
+				default:
+					return fmt.Errorf("env %v: unknown attribute %v", key, attr.Key)
+				}
+			}
+			// Values coming from a provider are secret by default.
+			if env.Provider != "" {
+				env.Secret = true
+			}
+			e.Add(env)
+			continue
+		}
+
+		e.Set(key, fmt.Sprintf("%v", v.Value))
 	}
 
 	return nil
 }
 
-// Set key to be equal value in this list.
+// Set key to be equal value in this list. Secret variables stay secret.
 func (e *EnvList) Set(key, value string) {
 	for i, v := range *e {
 		if v.Key == key {
 			(*e)[i].Value = value
+			(*e)[i].resolved = false
 			return
 		}
 	}
@@ -202,37 +307,155 @@ func (e *EnvList) Set(key, value string) {
 	})
 }
 
+// Add sets env in this list, including its secret attributes.
+func (e *EnvList) Add(env EnvVar) {
+	for i, v := range *e {
+		if v.Key == env.Key {
+			secret := v.Secret || env.Secret
+			*(*e)[i] = env
+			(*e)[i].Secret = secret
+			return
+		}
+	}
+
+	*e = append(*e, &env)
+}
+
+// Public returns the variables that are not secret.
+func (e EnvList) Public() EnvList {
+	var list EnvList
+	for _, v := range e {
+		if !v.Secret {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Secrets returns the secret variables only.
+func (e EnvList) Secrets() EnvList {
+	var list EnvList
+	for _, v := range e {
+		if v.Secret {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// SecretValues returns the non-empty values of all secret variables.
+func (e EnvList) SecretValues() []string {
+	var values []string
+	for _, v := range e {
+		if v.Secret && v.Value != "" {
+			values = append(values, v.Value)
+		}
+	}
+	return values
+}
+
+// ResolveValues resolves variable references and locally computed values.
+// Values are literal, except for `$VAR` and `${VAR}` references to the
+// variables defined earlier in the list (or in the local environment)
+// and for values computed by a local shell, ie. `sh: COMMAND`, values
+// with `$(COMMAND)` substitution and secret providers. All the computed
+// values are resolved in a single bash process and only once.
 func (e *EnvList) ResolveValues() error {
 	if len(*e) == 0 {
 		return nil
 	}
 
-	exports := ""
-	for i, v := range *e {
-		exports += v.AsExport()
+	computed := false
+	for _, v := range *e {
+		if !v.resolved && v.isComputed() {
+			computed = true
+			break
+		}
+	}
 
-		cmd := exec.Command("bash", "-c", exports+"echo -n "+v.Value+";")
-		cwd, err := os.Getwd()
-		if err != nil {
-			return err
+	// Resolve references in Go, unless there's a value to be computed.
+	if !computed {
+		values := map[string]string{}
+		for _, v := range *e {
+			if !v.resolved {
+				v.Value = expandRefs(v.Value, func(key string) (string, bool) {
+					value, ok := values[key]
+					if !ok {
+						value, ok = os.LookupEnv(key)
+					}
+					return value, ok
+				})
+				v.resolved = true
+			}
+			values[v.Key] = v.Value
 		}
-		cmd.Dir = cwd
-		resolvedValue, err := cmd.Output()
-		if err != nil {
-			return errors.Wrapf(err, "resolving env var %v failed", v.Key)
+		return nil
+	}
+
+	// Print all the values in order, separated by NUL bytes. Literal
+	// values, ie. secrets, are passed in env vars of the shell, so they
+	// never show up in its command line (and thus `ps` output).
+	script := ""
+	var literals []string
+	literal := func(text string) string {
+		name := "__SUP_LITERAL_" + strconv.Itoa(len(literals))
+		literals = append(literals, name+"="+text)
+		return `"$` + name + `"`
+	}
+	defined := map[string]bool{}
+	for _, v := range *e {
+		switch {
+		case v.resolved:
+			script += v.Key + "=" + literal(v.Value) + "; "
+		case v.isCommand():
+			script += v.Key + "=" + v.commandExpr() + " || exit 1; "
+		default:
+			script += v.Key + "=" + refsAsShellWord(v.Value, func(key string) bool {
+				if defined[key] {
+					return true
+				}
+				_, ok := os.LookupEnv(key)
+				return ok
+			}, literal) + " || exit 1; "
 		}
+		script += "export " + v.Key + "; printf '%s\\0' \"$" + v.Key + "\"; "
+		defined[v.Key] = true
+	}
 
-		(*e)[i].Value = string(resolvedValue)
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), literals...)
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cmd.Dir = cwd
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Values printed so far tell which variable failed.
+		if i := bytes.Count(out, []byte{0}); i < len(*e) {
+			return errors.Wrapf(err, "resolving env var %v failed", (*e)[i].Key)
+		}
+		return errors.Wrap(err, "resolving env vars failed")
+	}
+
+	values := strings.Split(string(out), "\x00")
+	if len(values) != len(*e)+1 {
+		return errors.New("resolving env vars failed: unexpected output")
+	}
+	for i, v := range *e {
+		v.Value = values[i]
+		v.resolved = true
 	}
 
 	return nil
 }
 
-func (e *EnvList) AsExport() string {
+func (e EnvList) AsExport() string {
 	// Process all ENVs into a string of form
 	// `export FOO="bar"; export BAR="baz";`.
 	exports := ``
-	for _, v := range *e {
+	for _, v := range e {
 		exports += v.AsExport() + " "
 	}
 	return exports
@@ -255,7 +478,43 @@ func (e ErrUnsupportedSupfileVersion) Error() string {
 }
 
 // NewSupfile parses configuration file and returns Supfile or error.
+// Imported Supfiles are resolved relative to the current directory.
 func NewSupfile(data []byte) (*Supfile, error) {
+	return newSupfile(data, ".", map[string]bool{})
+}
+
+// ReadSupfile reads and parses configuration file. Imported Supfiles
+// are resolved relative to the file's directory.
+func ReadSupfile(path string) (*Supfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSupfile(data, filepath.Dir(path), map[string]bool{abs: true})
+}
+
+// warnings holds the printed warnings, so Supfiles read more than once,
+// ie. by ValidateFile, warn only once.
+var warnings = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+func warnOnce(warning string) {
+	warnings.Lock()
+	defer warnings.Unlock()
+	if !warnings.m[warning] {
+		warnings.m[warning] = true
+		fmt.Fprint(os.Stderr, warning)
+	}
+}
+
+func newSupfile(data []byte, dir string, seen map[string]bool) (*Supfile, error) {
 	var conf Supfile
 
 	if err := yaml.Unmarshal(data, &conf); err != nil {
@@ -305,7 +564,7 @@ func NewSupfile(data []byte) (*Supfile, error) {
 			}
 		}
 		if warning != "" {
-			fmt.Fprintf(os.Stderr, warning)
+			warnOnce(warning)
 		}
 
 		fallthrough
@@ -316,50 +575,36 @@ func NewSupfile(data []byte) (*Supfile, error) {
 		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + conf.Version}
 	}
 
-	for i, network := range conf.Networks.nets {
-		hosts, err := network.ParseInventory()
-		if err != nil {
-			return nil, err
-		}
-		network.Hosts = append(network.Hosts, hosts...)
-		conf.Networks.nets[i] = network
+	if err := conf.resolveImports(dir, seen); err != nil {
+		return nil, err
 	}
 
 	return &conf, nil
 }
 
-// ParseInventory runs the inventory command, if provided, and appends
-// the command's output lines to the manually defined list of hosts.
+// ParseInventory runs the inventory command, if provided, and returns
+// the hosts it lists. See parseInventory for the supported formats.
 func (n Network) ParseInventory() ([]string, error) {
 	if n.Inventory == "" {
 		return nil, nil
 	}
 
-	cmd := exec.Command("/bin/sh", "-c", n.Inventory)
-	cmd.Stderr = os.Stderr
-	output, err := cmd.Output()
+	ttl, err := n.inventoryTTL()
+	if err != nil {
+		return nil, err
+	}
+	output, err := runInventory(n.Inventory, ttl, false)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := parseInventory(n.Name, output)
 	if err != nil {
 		return nil, err
 	}
 
 	var hosts []string
-	buf := bytes.NewBuffer(output)
-	for {
-		host, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-
-		host = strings.TrimSpace(host)
-		// skip empty lines and comments
-		if host == "" || host[:1] == "#" {
-			continue
-		}
-
-		hosts = append(hosts, host)
+	for _, host := range inventory {
+		hosts = append(hosts, host.String())
 	}
 	return hosts, nil
 }
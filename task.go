@@ -13,33 +13,71 @@ import (
 type Task struct {
 	Run     string
 	Input   io.Reader
+	Inputs  map[Client]io.Reader // Per-client input, used instead of Input.
 	Clients []Client
 	TTY     bool
+	Env     EnvList // Command-level env vars.
+
+	ForwardAgent bool // Forward local SSH agent to the session.
+
+	Become     bool // Run by sudo as BecomeUser, or root.
+	BecomeUser string
 }
 
-func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
+func (sup *Stackup) createTasks(cmd *Command, network *Network, clients []Client, vars EnvList) ([]*Task, error) {
 	var tasks []*Task
 
+	env := vars.Public().AsExport()
+	secrets := vars.Secrets()
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, errors.Wrap(err, "resolving CWD failed")
 	}
 
-	// Anything to upload?
-	for _, upload := range cmd.Upload {
-		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
+	// Command-level env vars.
+	var cmdEnv EnvList
+	if cmd.EnvFile != "" {
+		cmdEnv, err = LoadEnvFile(cmd.EnvFile)
 		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
+			return nil, err
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+	}
+
+	// Anything to upload?
+	for _, upload := range cmd.Upload {
+		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env+cmdEnv.Public().AsExport())
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
 
 		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
-			TTY:   false,
+			Run: RemoteTarCommand(upload.Dst),
+			TTY: false,
+			Env: cmdEnv,
+		}
+
+		if upload.Template {
+			// Render the files for every host separately.
+			task.Inputs = map[Client]io.Reader{}
+			data := NewTemplateData(network, append(append(EnvList{}, vars...), cmdEnv...))
+			seen := map[string]int{}
+			for i, c := range clients {
+				address := network.Hosts[i]
+				data.Host = data.hostOf(address, seen[address])
+				seen[address]++
+				uploadTarReader, err := NewTemplateTarReader(cwd, uploadFile, upload.Exc, data)
+				if err != nil {
+					return nil, errors.Wrap(err, "upload: "+upload.Src)
+				}
+				task.Inputs[c] = uploadTarReader
+			}
+		} else {
+			uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			task.Input = uploadTarReader
 		}
 
 		if cmd.Once {
@@ -74,8 +112,11 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		}
 
 		task := Task{
-			Run: string(data),
-			TTY: true,
+			Run:        string(data),
+			TTY:        true,
+			Env:        cmdEnv,
+			Become:     cmd.Become || cmd.BecomeUser != "",
+			BecomeUser: cmd.BecomeUser,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -106,13 +147,15 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 	// Local command.
 	if cmd.Local != "" {
 		local := &LocalhostClient{
-			env: env + `export SUP_HOST="localhost";`,
+			env:     env + EnvVar{Key: "SUP_HOST", Value: "localhost"}.AsExport(),
+			secrets: secrets,
 		}
 		local.Connect("localhost")
 		task := &Task{
 			Run:     cmd.Local,
 			Clients: []Client{local},
 			TTY:     true,
+			Env:     cmdEnv,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -126,8 +169,11 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 	// Remote command.
 	if cmd.Run != "" {
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Run:        cmd.Run,
+			TTY:        true,
+			Env:        cmdEnv,
+			Become:     cmd.Become || cmd.BecomeUser != "",
+			BecomeUser: cmd.BecomeUser,
 		}
 		if sup.debug {
 			task.Run = "set -x;" + task.Run
@@ -155,6 +201,10 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		}
 	}
 
+	for _, task := range tasks {
+		task.ForwardAgent = cmd.ForwardAgent || network.ForwardAgent
+	}
+
 	return tasks, nil
 }
 
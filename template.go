@@ -0,0 +1,176 @@
+package sup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TemplateData is available to upload templates, which are rendered
+// for every host separately.
+type TemplateData struct {
+	Env     map[string]string
+	Network string
+	Host    TemplateHost
+	Hosts   []TemplateHost
+}
+
+// TemplateHost describes a network host in upload templates.
+type TemplateHost struct {
+	Address string
+	Index   int
+	Tags    []string
+	Vars    map[string]string // Host vars, ie. from inventory file.
+}
+
+// NewTemplateData creates template data of a network with env vars.
+// Hosts lists all the network hosts, even if some were left out, ie. by
+// --only flag. The Host field is to be set for every host, see hostOf.
+func NewTemplateData(network *Network, vars EnvList) TemplateData {
+	data := TemplateData{
+		Env:     map[string]string{},
+		Network: network.Name,
+	}
+	for _, v := range vars {
+		data.Env[v.Key] = v.Value
+	}
+	for i, host := range network.AllHosts() {
+		hostVars := map[string]string{}
+		for _, v := range network.HostVars[host] {
+			hostVars[v.Key] = v.Value
+		}
+		data.Hosts = append(data.Hosts, TemplateHost{
+			Address: host,
+			Index:   i,
+			Tags:    network.HostTags[host],
+			Vars:    hostVars,
+		})
+	}
+	return data
+}
+
+// hostOf returns the host of address from Hosts. Address listed more times
+// is told apart by its occurrence, counted from zero.
+func (d TemplateData) hostOf(address string, occurrence int) TemplateHost {
+	for _, host := range d.Hosts {
+		if host.Address != address {
+			continue
+		}
+		if occurrence == 0 {
+			return host
+		}
+		occurrence--
+	}
+	return TemplateHost{Address: address, Index: -1}
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// NewTemplateTarReader creates a tar stream of a local path, similar to
+// NewTarStreamReader. All the files are rendered as Go text/template
+// with the given data.
+func NewTemplateTarReader(cwd, path, exclude string, data TemplateData) (io.Reader, error) {
+	var excludes []string
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	root := path
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(cwd, path)
+	}
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, pattern := range excludes {
+			if ok, _ := filepath.Match(pattern, info.Name()); ok {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		// Keep the paths relative to cwd, the same way tar does.
+		name := strings.TrimPrefix(file, "/")
+		if !filepath.IsAbs(path) {
+			name, err = filepath.Rel(cwd, file)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+
+		switch {
+		case info.IsDir():
+			header.Name += "/"
+			return tw.WriteHeader(header)
+
+		case info.Mode().IsRegular():
+			rendered, err := renderTemplate(file, data)
+			if err != nil {
+				return err
+			}
+			header.Size = int64(len(rendered))
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err = tw.Write(rendered)
+			return err
+
+		default:
+			return errors.Errorf("%v: only regular files can be rendered", name)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "template")
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func renderTemplate(file string, data TemplateData) ([]byte, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(filepath.Base(file)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
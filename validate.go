@@ -0,0 +1,433 @@
+package sup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError describes a problem found in a Supfile. Line and Column
+// are 1-based, zero if the location is unknown.
+type ValidationError struct {
+	File   string
+	Line   int
+	Column int
+	Key    string // Dot separated path of the key, ie. "commands.deploy".
+	Msg    string
+}
+
+func (e ValidationError) Error() string {
+	switch {
+	case e.File == "":
+		return e.Msg
+	case e.Line == 0:
+		return fmt.Sprintf("%v: %v", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%v:%v:%v: %v", e.File, e.Line, e.Column, e.Msg)
+}
+
+// ValidationErrors is a list of all the problems found in a Supfile.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ValidateFile validates the Supfile at path, including its imports.
+// Unlike NewSupfile, it rejects unknown keys. It returns ValidationErrors
+// describing all the problems found.
+func ValidateFile(path string) error {
+	var errs ValidationErrors
+	validateKeys(path, map[string]bool{}, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	conf, err := ReadSupfile(path)
+	if err != nil {
+		return ValidationErrors{{File: path, Msg: err.Error()}}
+	}
+
+	if err := conf.Validate(); err != nil {
+		// Errors of imported entries are located in their Supfiles.
+		files := map[string][]string{}
+		for _, err := range err.(ValidationErrors) {
+			err.File = path
+			key := err.Key
+			if src, ok := conf.source(err.Key); ok {
+				err.File, key = src.file, src.key
+			}
+			lines, ok := files[err.File]
+			if !ok {
+				data, _ := ioutil.ReadFile(err.File)
+				lines = strings.Split(string(data), "\n")
+				files[err.File] = lines
+			}
+			err.Line, err.Column = locateKey(lines, strings.Split(key, "."))
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks that targets reference existing commands, commands have
+// something to run, script files exist and networks have hosts.
+// Failures are returned as ValidationErrors without location.
+func (conf *Supfile) Validate() error {
+	var errs ValidationErrors
+
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		if len(network.Hosts) == 0 && network.Inventory == "" && network.InventoryFile == "" {
+			errs = append(errs, ValidationError{
+				Key: "networks." + name,
+				Msg: fmt.Sprintf("network %v has no hosts nor inventory", name),
+			})
+		}
+		if network.InventoryFile != "" {
+			if _, err := os.Stat(network.InventoryFile); err != nil {
+				errs = append(errs, ValidationError{
+					Key: "networks." + name + ".inventory_file",
+					Msg: fmt.Sprintf("network %v: %v", name, err),
+				})
+			}
+		}
+		for _, method := range network.Auth {
+			switch method {
+			case AuthPublicKey, AuthPassword, AuthKeyboardInteractive:
+			default:
+				errs = append(errs, ValidationError{
+					Key: "networks." + name + ".auth",
+					Msg: fmt.Sprintf("network %v: unknown auth method %q", name, method),
+				})
+			}
+		}
+		if network.CertificateFile != "" {
+			if _, err := os.Stat(expandHome(network.CertificateFile)); err != nil {
+				errs = append(errs, ValidationError{
+					Key: "networks." + name + ".certificate_file",
+					Msg: fmt.Sprintf("network %v: %v", name, err),
+				})
+			}
+		}
+		if _, err := network.inventoryTTL(); err != nil {
+			errs = append(errs, ValidationError{
+				Key: "networks." + name + ".inventory_ttl",
+				Msg: fmt.Sprintf("network %v: %v", name, err),
+			})
+		}
+		if _, err := network.controlPersist(); err != nil {
+			errs = append(errs, ValidationError{
+				Key: "networks." + name + ".control_persist",
+				Msg: fmt.Sprintf("network %v: %v", name, err),
+			})
+		}
+		if _, _, err := network.serverAlive(); err != nil {
+			errs = append(errs, ValidationError{
+				Key: "networks." + name + ".server_alive_interval",
+				Msg: fmt.Sprintf("network %v: %v", name, err),
+			})
+		}
+		if err := validateProxy(network.Proxy, network.ProxyCommand); err != nil {
+			errs = append(errs, ValidationError{
+				Key: "networks." + name + ".proxy",
+				Msg: fmt.Sprintf("network %v: %v", name, err),
+			})
+		}
+	}
+	if err := validateProxy(conf.Proxy, conf.ProxyCommand); err != nil {
+		errs = append(errs, ValidationError{Key: "proxy", Msg: err.Error()})
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		hasTasks := cmd.Run != "" || cmd.Local != "" || cmd.Script != "" || len(cmd.Upload) > 0
+		switch {
+		case !hasTasks && len(cmd.Forward) == 0:
+			errs = append(errs, ValidationError{
+				Key: "commands." + name,
+				Msg: fmt.Sprintf("command %v has none of run, local, script, upload or forward", name),
+			})
+		case hasTasks && len(cmd.Forward) > 0:
+			errs = append(errs, ValidationError{
+				Key: "commands." + name + ".forward",
+				Msg: fmt.Sprintf("command %v: forward can't be combined with run, local, script or upload", name),
+			})
+		}
+		for i, fwd := range cmd.Forward {
+			if fwd.Remote == "" || fwd.Reverse && fwd.Local == "" {
+				errs = append(errs, ValidationError{
+					Key: fmt.Sprintf("commands.%v.forward.[%v]", name, i),
+					Msg: fmt.Sprintf("command %v: forward %v needs remote address (and local one if reverse)", name, i+1),
+				})
+			}
+		}
+		if cmd.Script != "" {
+			if _, err := os.Stat(cmd.Script); err != nil {
+				errs = append(errs, ValidationError{
+					Key: "commands." + name + ".script",
+					Msg: fmt.Sprintf("command %v: %v", name, err),
+				})
+			}
+		}
+	}
+
+	for _, name := range conf.Targets.Names {
+		cmds, _ := conf.Targets.Get(name)
+		for _, cmd := range cmds {
+			if _, ok := conf.Commands.Get(cmd); !ok {
+				errs = append(errs, ValidationError{
+					Key: "targets." + name,
+					Msg: fmt.Sprintf("target %v references unknown command %v", name, cmd),
+				})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateKeys reports unknown keys in the Supfile at path and its imports.
+func validateKeys(path string, seen map[string]bool, errs *ValidationErrors) {
+	abs, _ := filepath.Abs(path)
+	if seen[abs] {
+		return
+	}
+	seen[abs] = true
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, ValidationError{File: path, Msg: err.Error()})
+		return
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		*errs = append(*errs, ValidationError{File: path, Msg: err.Error()})
+		return
+	}
+
+	lines := strings.Split(string(data), "\n")
+	checkKeys(doc, reflect.TypeOf(Supfile{}), nil, func(keyPath []string, msg string) {
+		line, col := locateKey(lines, keyPath)
+		*errs = append(*errs, ValidationError{
+			File:   path,
+			Line:   line,
+			Column: col,
+			Key:    joinKeyPath(keyPath),
+			Msg:    msg,
+		})
+	})
+
+	// Imported Supfiles.
+	var conf struct {
+		Imports []Import `yaml:"imports"`
+	}
+	if yaml.Unmarshal(data, &conf) == nil {
+		for _, imp := range conf.Imports {
+			if imp.Path == "" {
+				continue
+			}
+			importPath := imp.Path
+			if !filepath.IsAbs(importPath) {
+				importPath = filepath.Join(filepath.Dir(path), importPath)
+			}
+			validateKeys(importPath, seen, errs)
+		}
+	}
+}
+
+var (
+	networksType = reflect.TypeOf(Networks{})
+	commandsType = reflect.TypeOf(Commands{})
+	targetsType  = reflect.TypeOf(Targets{})
+	envListType  = reflect.TypeOf(EnvList{})
+	importType   = reflect.TypeOf(Import{})
+)
+
+// checkKeys walks the decoded YAML value along with the Go type it's
+// decoded into and reports keys the type doesn't know.
+func checkKeys(value interface{}, t reflect.Type, keyPath []string, report func(keyPath []string, msg string)) {
+	switch t {
+	case networksType:
+		t = reflect.TypeOf(map[string]Network{})
+	case commandsType:
+		t = reflect.TypeOf(map[string]Command{})
+	case targetsType:
+		t = reflect.TypeOf(map[string][]string{})
+	case envListType:
+		// Env var is either a scalar or {value, secret, provider} map.
+		for _, item := range mapItems(value) {
+			if attrs := mapItems(item.Value); attrs != nil {
+				for _, attr := range attrs {
+					key := fmt.Sprintf("%v", attr.Key)
+					if key != "value" && key != "secret" && key != "provider" {
+						varPath := append(keyPath, fmt.Sprintf("%v", item.Key))
+						report(append(varPath, key), fmt.Sprintf("unknown key %q in %v", key, joinKeyPath(varPath)))
+					}
+				}
+			}
+		}
+		return
+	case importType:
+		if _, ok := value.(string); ok {
+			return
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		for _, item := range mapItems(value) {
+			key := fmt.Sprintf("%v", item.Key)
+			field, ok := fields[key]
+			if !ok {
+				msg := fmt.Sprintf("unknown key %q", key)
+				if len(keyPath) > 0 {
+					msg += " in " + joinKeyPath(keyPath)
+				}
+				report(append(keyPath, key), msg)
+				continue
+			}
+			checkKeys(item.Value, field, append(keyPath, key), report)
+		}
+
+	case reflect.Map:
+		for _, item := range mapItems(value) {
+			checkKeys(item.Value, t.Elem(), append(keyPath, fmt.Sprintf("%v", item.Key)), report)
+		}
+
+	case reflect.Slice:
+		if list, ok := value.([]interface{}); ok {
+			for i, v := range list {
+				checkKeys(v, t.Elem(), append(keyPath, fmt.Sprintf("[%v]", i)), report)
+			}
+		}
+	}
+}
+
+// joinKeyPath joins key path with dots, ie. "commands.deploy.upload[0]".
+func joinKeyPath(keyPath []string) string {
+	return strings.Replace(strings.Join(keyPath, "."), ".[", "[", -1)
+}
+
+// mapItems returns items of a decoded YAML map, nil if value isn't a map.
+func mapItems(value interface{}) []yaml.MapItem {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		return v
+	case []yaml.MapItem:
+		return v
+	}
+	return nil
+}
+
+// yamlFields returns struct field types by their YAML keys,
+// following the yaml package's naming rules.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported.
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// locateKey finds line and column of a key path, ie. ["commands", "deploy",
+// "upload", "[0]", "src"], in a block style YAML document. It returns
+// location of the deepest key found, zeros if none.
+func locateKey(lines []string, keyPath []string) (line, col int) {
+	start, indent, itemLine := 0, -1, -1
+	for _, key := range keyPath {
+		index := -1
+		if strings.HasPrefix(key, "[") {
+			fmt.Sscanf(key, "[%d]", &index)
+		}
+
+		found := false
+		childIndent := -1
+		for i := start; i < len(lines) && !found; i++ {
+			text := strings.TrimRight(lines[i], " \t\r")
+			trimmed := strings.TrimLeft(text, " ")
+			if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+				continue
+			}
+			lineIndent := len(text) - len(trimmed)
+			if lineIndent <= indent && i != itemLine {
+				break // End of the parent block.
+			}
+
+			// The first key of a list item is on the same line as "- ".
+			keyText, keyIndent := trimmed, lineIndent
+			isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+			if isItem {
+				keyText = strings.TrimLeft(trimmed[1:], " ")
+				keyIndent = lineIndent + len(trimmed) - len(keyText)
+			}
+
+			if index >= 0 {
+				if !isItem || i == itemLine {
+					continue
+				}
+				if childIndent < 0 {
+					childIndent = lineIndent
+				}
+				if lineIndent != childIndent {
+					continue
+				}
+				if index > 0 {
+					index--
+					continue
+				}
+				start, indent, itemLine = i, lineIndent, i
+				line, col = i+1, lineIndent+1
+				found = true
+				continue
+			}
+
+			// Direct children only.
+			if childIndent < 0 {
+				childIndent = keyIndent
+			}
+			if keyIndent != childIndent {
+				continue
+			}
+			for _, quoted := range []string{key, `"` + key + `"`, `'` + key + `'`} {
+				if strings.HasPrefix(keyText, quoted+":") {
+					start, indent, itemLine = i+1, keyIndent, -1
+					line, col = i+1, keyIndent+1
+					found = true
+				}
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return line, col
+}
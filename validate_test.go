@@ -0,0 +1,150 @@
+package sup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocateKey(t *testing.T) {
+	doc := `# comment
+version: 0.5
+env:
+  deploy: top
+networks:
+  production:
+    env:
+      deploy: network
+    hosts:
+      - web1
+
+      - web2
+commands:
+  "deploy":
+    upload:
+      - src: ./a
+        dst: /tmp
+      # comment
+      - src: ./b
+        dst: /tmp
+    env:
+      deploy: command
+  'quoted':
+    run: echo
+`
+	lines := strings.Split(doc, "\n")
+
+	tests := []struct {
+		key       string
+		line, col int
+	}{
+		{"version", 2, 1},
+		{"env.deploy", 4, 3},
+		{"networks.production.env.deploy", 8, 7},
+		{"commands.deploy.env.deploy", 22, 7},
+		{"commands.deploy", 14, 3},
+		{"commands.quoted.run", 24, 5},
+		{"networks.production.hosts.[1]", 12, 7},
+		{"commands.deploy.upload.[0].src", 16, 9},
+		{"commands.deploy.upload.[1]", 19, 7},
+		{"commands.deploy.upload.[1].dst", 20, 9},
+
+		// Deepest key found.
+		{"networks.production.missing", 6, 3},
+		{"commands.deploy.upload.[2]", 15, 5},
+		{"networks.deploy", 5, 1},
+		{"deploy", 0, 0},
+		{"missing.env", 0, 0},
+	}
+	for _, tt := range tests {
+		line, col := locateKey(lines, strings.Split(tt.key, "."))
+		if line != tt.line || col != tt.col {
+			t.Errorf("locateKey(%v) = %v:%v, want %v:%v", tt.key, line, col, tt.line, tt.col)
+		}
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Supfile": `version: 0.5
+imports:
+  - path: sub/Supfile
+    namespace: sub
+env:
+  auth: top
+networks:
+  production:
+    hosts:
+      - example.com
+    auth:
+      - magic
+commands:
+  auth:
+    run: echo
+targets:
+  all:
+    - auth
+    - nope
+`,
+		"sub/Supfile": `version: 0.5
+imports:
+  - deep/Supfile
+networks:
+  staging:
+    inventory_ttl: soon
+    hosts:
+      - staging.example.com
+commands:
+  deploy:
+    desc: nothing to run
+`,
+		"sub/deep/Supfile": `version: 0.5
+commands:
+  auth:
+    run: echo
+  upload:
+    forward:
+      - local: 8080
+`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ValidateFile(filepath.Join(dir, "Supfile"))
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateFile() = %v, want ValidationErrors", err)
+	}
+	var locations []string
+	for _, err := range errs {
+		rel, _ := filepath.Rel(dir, err.File)
+		locations = append(locations, fmt.Sprintf("%v:%v:%v %v", rel, err.Line, err.Column, err.Key))
+	}
+	want := []string{
+		"Supfile:11:5 networks.production.auth",
+		"sub/Supfile:6:5 networks.staging.inventory_ttl",
+		"sub/Supfile:10:3 commands.sub:deploy",
+		"sub/deep/Supfile:7:7 commands.sub:upload.forward.[0]",
+		"Supfile:17:3 targets.all",
+	}
+	if !reflect.DeepEqual(locations, want) {
+		t.Errorf("ValidateFile() errors at\n%q\nwant\n%q\n%v", locations, want, err)
+	}
+}